@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"ladder/handlers"
 	"ladder/handlers/cli"
@@ -13,6 +16,7 @@ import (
 	"github.com/akamensky/argparse"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/basicauth"
+	"github.com/gofiber/fiber/v2/middleware/compress"
 	"github.com/gofiber/fiber/v2/middleware/favicon"
 )
 
@@ -23,6 +27,11 @@ var faviconData string
 var cssData embed.FS
 
 func main() {
+	// utility subcommands, e.g. `ladder ruleset lint`
+	if len(os.Args) > 1 && os.Args[1] == "ruleset" {
+		os.Exit(cli.HandleRulesetCommand(os.Args))
+	}
+
 	parser := argparse.NewParser("ladder", "Every Wall needs a Ladder")
 
 	portEnv := os.Getenv("PORT")
@@ -56,6 +65,16 @@ func main() {
 		Help:     "Compiles a directory of yaml files into a single ruleset.gz Requires --ruleset arg.",
 	})
 
+	mergeRulesetsKeepRefs := parser.Flag("", "merge-rulesets-keep-refs", &argparse.Options{
+		Required: false,
+		Help:     "Keep fragments, extends and include references in the merged ruleset instead of resolving them. Requires --merge-rulesets or --merge-rulesets-gzip.",
+	})
+
+	mergeRulesetsSign := parser.String("", "merge-rulesets-sign", &argparse.Options{
+		Required: false,
+		Help:     "Sign the merged ruleset with a private key file from `ladder ruleset keygen`. Writes the signature to the output file with a .sig suffix. Requires --merge-rulesets-output.",
+	})
+
 	mergeRulesetsOutput := parser.String("", "merge-rulesets-output", &argparse.Options{
 		Required: false,
 		Help:     "Specify output file for --merge-rulesets and --merge-rulesets-gzip. Requires --ruleset and --merge-rulesets args.",
@@ -79,7 +98,7 @@ func main() {
 			}
 		}
 
-		err = cli.HandleRulesetMerge(*ruleset, *mergeRulesets, *mergeRulesetsGzip, output)
+		err = cli.HandleRulesetMerge(*ruleset, *mergeRulesets || *mergeRulesetsGzip, *mergeRulesetsGzip, *mergeRulesetsKeepRefs, *mergeRulesetsSign, output)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -102,9 +121,10 @@ func main() {
 
 	app := fiber.New(
 		fiber.Config{
-			Prefork:       *prefork,
-			StrictRouting: true,
+			Prefork:        *prefork,
+			StrictRouting:  true,
 			ReadBufferSize: 16 * 1024,
+			BodyLimit:      handlers.MaxRequestBodySize,
 		},
 	)
 
@@ -124,6 +144,11 @@ func main() {
 		URL:  basePath + "/favicon.ico",
 	}))
 
+	// responses are compressed according to the Accept-Encoding of the client
+	if os.Getenv("DISABLE_COMPRESSION") != "true" {
+		app.Use(compress.New())
+	}
+
 	if os.Getenv("NOLOGS") != "true" {
 		app.Use(func(c *fiber.Ctx) error {
 			log.Println(c.Method(), c.Path())
@@ -155,10 +180,37 @@ func main() {
 	})
 
 	router.Get("/ruleset", handlers.Ruleset)
+	router.Get("/_ladder/runtime.js", handlers.Runtime)
+	router.Get("/_ladder/sw.js", handlers.ServiceWorker)
+	router.Get("/_ladder/session", handlers.Session)
+	router.Delete("/_ladder/session", handlers.ClearSession)
+	router.Post("/admin/ruleset/reload", handlers.AdminAuth, handlers.AdminReloadRuleset)
+	router.Get("/admin/sessions/:id", handlers.AdminAuth, handlers.AdminSession)
+	router.Delete("/admin/sessions/:id", handlers.AdminAuth, handlers.AdminClearSession)
+	router.Delete("/admin/cache", handlers.AdminAuth, handlers.AdminPurgeCache)
 	router.Get("/raw/*", handlers.Raw)
 	router.Post("/api", handlers.Api)
 	router.Get("/api/*", handlers.Api)
-	router.Get("/*", handlers.ProxySite(*ruleset))
+
+	proxy := handlers.ProxySite(*ruleset)
+	router.Get("/*", proxy)
+	for _, method := range []string{fiber.MethodPost, fiber.MethodPut, fiber.MethodPatch, fiber.MethodDelete, fiber.MethodOptions} {
+		router.Add(method, "/*", proxy)
+	}
+
+	handlers.WatchRuleset(context.Background())
+
+	// SIGHUP forces a ruleset reload
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		for range hup {
+			if err := handlers.ReloadRuleset(); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
 
 	log.Fatal(app.Listen(":" + *port))
 }
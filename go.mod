@@ -5,25 +5,26 @@ go 1.26
 require (
 	github.com/PuerkitoBio/goquery v1.12.0
 	github.com/akamensky/argparse v1.4.0
+	github.com/andybalholm/brotli v1.2.1
+	github.com/andybalholm/cascadia v1.3.3
 	github.com/gofiber/fiber/v2 v2.52.13
+	github.com/klauspost/compress v1.18.5
 	github.com/stretchr/testify v1.11.1
+	golang.org/x/net v0.52.0
+	golang.org/x/text v0.35.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require github.com/clipperhouse/uax29/v2 v2.7.0 // indirect
 
 require (
-	github.com/andybalholm/brotli v1.2.1 // indirect
-	github.com/andybalholm/cascadia v1.3.3 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/klauspost/compress v1.18.5 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.22 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.70.0 // indirect
-	golang.org/x/net v0.52.0 // indirect
 	golang.org/x/sys v0.42.0 // indirect
 )
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// AdminAuth guards the /admin endpoints. They are disabled unless ADMIN_TOKEN is set,
+// and every request must carry the token as `Authorization: Bearer <token>`.
+func AdminAuth(c *fiber.Ctx) error {
+	if adminToken == "" {
+		c.SendStatus(fiber.StatusForbidden)
+		return c.SendString("Admin API Disabled")
+	}
+
+	token := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		c.SendStatus(fiber.StatusUnauthorized)
+		return c.SendString("Unauthorized")
+	}
+
+	return c.Next()
+}
+
+// AdminReloadRuleset forces a reload of the ruleset.
+// If the reload fails, the previous ruleset stays active and the error is returned.
+func AdminReloadRuleset(c *fiber.Ctx) error {
+	if err := ReloadRuleset(); err != nil {
+		log.Println("ERROR:", err)
+		c.SendStatus(fiber.StatusInternalServerError)
+		return c.SendString(err.Error())
+	}
+
+	rs := rules.Current().RuleSet()
+
+	return c.JSON(fiber.Map{
+		"rules":   rs.Count(),
+		"domains": rs.DomainCount(),
+	})
+}
@@ -33,18 +33,35 @@ func Api(c *fiber.Ctx) error {
 		url = c.Params("*")
 	}
 
-	body, req, resp, err := fetchSite(url, queries)
+	var body string
+
+	result, err := fetchSite(url, queries, nil)
+	if err == nil {
+		body, err = result.bufferedBody()
+	}
 	if err != nil {
 		log.Println("ERROR:", err)
-		c.SendStatus(500)
+		c.SendStatus(errorStatus(err))
 		return c.SendString(err.Error())
 	}
 
+	req, resp := result.req, result.resp
+
 	response := Response{
 		Version: version,
 		Body:    body,
 	}
 
+	response.Redirects = result.redirects
+	if response.Redirects == nil {
+		response.Redirects = []redirectHop{}
+	}
+
+	response.Rule.MatchedBy = result.matchedBy
+	if response.Rule.MatchedBy == nil {
+		response.Rule.MatchedBy = []string{}
+	}
+
 	response.Request.Headers = make([]any, 0, len(req.Header))
 	for k, v := range req.Header {
 		response.Request.Headers = append(response.Request.Headers, map[string]string{
@@ -53,6 +70,7 @@ func Api(c *fiber.Ctx) error {
 		})
 	}
 
+	response.Response.Status = resp.StatusCode
 	response.Response.Headers = make([]any, 0, len(resp.Header))
 	for k, v := range resp.Header {
 		response.Response.Headers = append(response.Response.Headers, map[string]string{
@@ -67,10 +85,16 @@ func Api(c *fiber.Ctx) error {
 type Response struct {
 	Version string `json:"version"`
 	Body    string `json:"body"`
+	// Redirects are the redirects that were followed, the last Location is the URL of Body.
+	Redirects []redirectHop `json:"redirects"`
+	Rule      struct {
+		MatchedBy []string `json:"matchedBy"`
+	} `json:"rule"`
 	Request struct {
 		Headers []interface{} `json:"headers"`
 	} `json:"request"`
 	Response struct {
+		Status  int           `json:"status"`
 		Headers []interface{} `json:"headers"`
 	} `json:"response"`
 }
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	"ladder/pkg/ruleset"
+)
+
+// errBodyTooLarge is returned when an upstream body that must be buffered for rewriting
+// is larger than MAX_BODY_SIZE. Handlers answer it with 502 Bad Gateway.
+var errBodyTooLarge = errors.New("upstream response body exceeds MAX_BODY_SIZE")
+
+// errRequestBodyTooLarge is returned when a request body to forward is larger than
+// MAX_REQUEST_BODY_SIZE. Handlers answer it with 413 Request Entity Too Large.
+var errRequestBodyTooLarge = errors.New("request body exceeds MAX_REQUEST_BODY_SIZE")
+
+// errMethodNotAllowed is returned when the rule of a URL does not allow the request method.
+// Handlers answer it with 405 Method Not Allowed.
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// sniffContentType returns the Content-Type of an upstream response. If the upstream did not
+// send one, it is sniffed from the start of the body, which stays readable from resp.Body.
+func sniffContentType(resp *http.Response) string {
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+
+	br := bufio.NewReader(resp.Body)
+	peek, _ := br.Peek(512)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+
+	return http.DetectContentType(peek)
+}
+
+// needsRewrite reports whether a body with the content type must be buffered to be rewritten.
+// HTML and CSS links are always rewritten into the proxy, other bodies only if a regex rule
+// of the rule explicitly targets their content type. Everything else is streamed.
+func needsRewrite(contentType string, rule ruleset.Rule) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "text/css":
+		return true
+	}
+
+	for _, regexRule := range rule.RegexRules {
+		if regexRule.When.HasContentType() && regexRule.When.MatchContentType(contentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readBody reads an upstream body for rewriting, up to maxBodySize bytes.
+func readBody(resp *http.Response) ([]byte, error) {
+	if resp.ContentLength > maxBodySize {
+		return nil, fmt.Errorf("%w: %s sent %d bytes", errBodyTooLarge, resp.Request.URL, resp.ContentLength)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(body)) > maxBodySize {
+		return nil, fmt.Errorf("%w: %s sent more than %d bytes", errBodyTooLarge, resp.Request.URL, maxBodySize)
+	}
+
+	return body, nil
+}
+
+// bufferedBody returns the body of a result. A streamed body is read, up to maxBodySize bytes,
+// for handlers that need the whole body.
+func (r *fetchResult) bufferedBody() (string, error) {
+	if r.stream == nil {
+		return r.body, nil
+	}
+
+	defer r.stream.Close()
+
+	body, err := readBody(r.resp)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// errorStatus maps an error of fetchSite to the status code of the response.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errBodyTooLarge), errors.Is(err, errTooManyRedirects):
+		return http.StatusBadGateway
+	case errors.Is(err, errRequestBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errMethodNotAllowed):
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, errUpstreamTimeout):
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxySiteStreamsBodies(t *testing.T) {
+	image := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 1024)
+	html := "<html><body>" + strings.Repeat("x", 100) + `<a href="/next">next</a></body></html>`
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Content-Length", strconv.Itoa(len(image)))
+			w.Write(image)
+		case "/large.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(bytes.Repeat([]byte{0}, 4096))
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(html))
+		}
+	}))
+	defer upstream.Close()
+
+	defer func(size int64) { maxBodySize = size }(maxBodySize)
+	maxBodySize = 1024
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	// not rewritten, streamed with the original length even though it exceeds the limit
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/image.png", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(image)), resp.ContentLength)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, image, body)
+
+	// streamed without a known length
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/large.png", nil))
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Len(t, body, 4096)
+
+	// rewritten
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/page", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `href="/`+upstream.URL+`/next"`)
+
+	// too large to be rewritten
+	maxBodySize = 64
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/page", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestProxySiteRewritesRuleContentType(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"ads":true}`))
+	}))
+	defer upstream.Close()
+
+	// the only matching rule restricts itself to JSON, so JSON is buffered and rewritten
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	os.WriteFile(path, []byte(`
+- domain: 127.0.0.1
+  when:
+    contentType: application/json
+  regexRules:
+    - match: '"ads":true'
+      replace: '"ads":false'
+`), 0o644)
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(path))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/api", nil))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, `{"ads":false}`, string(body))
+}
@@ -0,0 +1,695 @@
+package handlers
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The response cache keeps upstream responses, so pages and their assets are not fetched
+// from the origin again while they are fresh. It follows the caching headers of the origin
+// like a shared HTTP cache, and revalidates stale responses with their ETag or Last-Modified.
+//
+// It has a memory tier and an optional disk tier that survives restarts, both evicting the
+// least recently used entries. Besides the upstream responses it keeps the rewritten bodies,
+// keyed on the upstream body and the rule, so a rule change only invalidates those.
+
+// maxHeuristicFreshness caps the freshness of responses without explicit caching headers,
+// which is a tenth of the time since they were last modified.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// responses is the response cache, nil if CACHE is not enabled.
+var responses *responseCache
+
+func init() {
+	if os.Getenv("CACHE") != "true" {
+		return
+	}
+
+	memorySize, diskSize := int64(64<<20), int64(1<<30)
+	if size, err := strconv.ParseInt(os.Getenv("CACHE_MEMORY_SIZE"), 10, 64); err == nil && size > 0 {
+		memorySize = size
+	}
+	if size, err := strconv.ParseInt(os.Getenv("CACHE_DISK_SIZE"), 10, 64); err == nil && size > 0 {
+		diskSize = size
+	}
+
+	var err error
+	responses, err = newResponseCache(memorySize, os.Getenv("CACHE_DIR"), diskSize)
+	if err != nil {
+		log.Fatalf("CACHE_DIR: %s", err)
+	}
+}
+
+// cacheEntry is a cached upstream response, or a rewritten body, which only has a Body.
+type cacheEntry struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Stored is when the response was received or last revalidated.
+	Stored time.Time
+	// Age is the age of the response when it was stored, from its Age and Date headers.
+	Age time.Duration
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Body))
+	for name, values := range e.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+
+	return size
+}
+
+// cachePolicy returns how long a response is fresh and whether it may be stored at all.
+// The ttl of the rule overrides the caching headers of the response.
+func cachePolicy(status int, header http.Header, stored time.Time, rule ruleset.Rule) (time.Duration, bool) {
+	heuristic := false
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMultipleChoices,
+		http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusNotFound,
+		http.StatusMethodNotAllowed, http.StatusGone, http.StatusRequestURITooLong, http.StatusNotImplemented:
+		heuristic = true
+	case http.StatusFound, http.StatusTemporaryRedirect:
+	default:
+		return 0, false
+	}
+
+	// responses that set cookies or vary on anything are never shared
+	if len(header.Values("Set-Cookie")) > 0 || strings.Contains(header.Get("Vary"), "*") {
+		return 0, false
+	}
+
+	if rule.Cache.TTL > 0 {
+		return rule.Cache.TTL, true
+	}
+
+	cc := cacheControl(header)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+
+	validated := header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+	if _, ok := cc["no-cache"]; ok {
+		return 0, validated
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if v, ok := cc[directive]; ok {
+			seconds, err := strconv.Atoi(v)
+			if err != nil || seconds <= 0 {
+				return 0, validated
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	date := stored
+	if d, err := http.ParseTime(header.Get("Date")); err == nil {
+		date = d
+	}
+
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(date) {
+			return 0, validated
+		}
+		return t.Sub(date), true
+	}
+
+	if lastModified, err := http.ParseTime(header.Get("Last-Modified")); err == nil && heuristic && date.After(lastModified) {
+		return min(date.Sub(lastModified)/10, maxHeuristicFreshness), true
+	}
+
+	return 0, validated && heuristic
+}
+
+// cacheControl parses the Cache-Control directives of a response.
+func cacheControl(header http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+
+	return cc
+}
+
+// fresh reports whether the cached response can be used without asking the origin.
+func (e *cacheEntry) fresh(rule ruleset.Rule) bool {
+	if e == nil {
+		return false
+	}
+
+	lifetime, ok := cachePolicy(e.StatusCode, e.Header, e.Stored, rule)
+	return ok && e.Age+time.Since(e.Stored) < lifetime
+}
+
+// addValidators turns an upstream request into a revalidation of the cached response.
+func (e *cacheEntry) addValidators(req *http.Request) {
+	if e == nil {
+		return
+	}
+	if etag := e.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// cachedResponse returns the cached response as the response to req, with its current Age.
+func (e *cacheEntry) cachedResponse(req *http.Request) *http.Response {
+	resp := e.response(req)
+	resp.Header.Set("Age", strconv.Itoa(int((e.Age + time.Since(e.Stored)).Seconds())))
+
+	return resp
+}
+
+// response returns the response of the entry as the response to req.
+func (e *cacheEntry) response(req *http.Request) *http.Response {
+	header := e.Header.Clone()
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode)),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// newCacheEntry returns the entry for an upstream response with its decoded body.
+func newCacheEntry(status int, header http.Header, body []byte) *cacheEntry {
+	e := &cacheEntry{
+		StatusCode: status,
+		Header:     header.Clone(),
+		Body:       body,
+		Stored:     time.Now(),
+	}
+	e.Header.Del("Content-Length")
+	e.Age = responseAge(header, e.Stored)
+
+	return e
+}
+
+// responseAge returns the age of a response received at the time, from its Age and Date headers.
+func responseAge(header http.Header, received time.Time) time.Duration {
+	var age time.Duration
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header.Get("Date")); err == nil && received.Sub(date) > age {
+		age = received.Sub(date)
+	}
+
+	return age
+}
+
+// bufferingBody passes an upstream body through and keeps a copy of it. done is called once,
+// with the whole body when it was read to the end, or with ok false if the body is larger
+// than the limit, its read failed, or it was closed before its end. The body is handed over
+// to done, the bufferingBody does not touch it afterwards.
+type bufferingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	done  func(body []byte, ok bool)
+}
+
+func (b *bufferingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done == nil {
+		return n, err
+	}
+
+	switch {
+	case int64(b.buf.Len()+n) > b.limit:
+		b.finish(false)
+	case err == io.EOF:
+		b.buf.Write(p[:n])
+		b.finish(true)
+	case err != nil:
+		b.finish(false)
+	default:
+		b.buf.Write(p[:n])
+	}
+
+	return n, err
+}
+
+func (b *bufferingBody) Close() error {
+	if b.done != nil {
+		b.finish(false)
+	}
+
+	return b.ReadCloser.Close()
+}
+
+// onDone adds a function that is called with the body after done, so the body is buffered
+// once for both.
+func (b *bufferingBody) onDone(done func(body []byte, ok bool)) {
+	first := b.done
+	b.done = func(body []byte, ok bool) {
+		first(body, ok)
+		done(body, ok)
+	}
+}
+
+func (b *bufferingBody) finish(ok bool) {
+	done := b.done
+	b.done = nil
+	if ok {
+		done(b.buf.Bytes(), true)
+	} else {
+		done(nil, false)
+	}
+	b.buf = bytes.Buffer{}
+}
+
+// cacheable reports whether the upstream request of a rule goes through the response cache.
+// Only GET requests without session cookies are cached, so the cache never holds private
+// responses.
+func cacheable(req *http.Request, rule ruleset.Rule, fwd *forwardedRequest) bool {
+	if responses == nil || rule.Cache.Disabled || req.Method != http.MethodGet {
+		return false
+	}
+
+	return fwd.jar == nil || len(fwd.jar.Cookies(req.URL)) == 0
+}
+
+// upstreamKey returns the cache key of an upstream request: its URL and every header the
+// rule made it send. Two rules that send the same request share the response.
+func upstreamKey(req *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL)
+	writeHeader(h, req.Header)
+
+	return cacheKey(req.URL.String(), h.Sum(nil))
+}
+
+// rewrittenKey returns the cache key of the rewritten body of an upstream response of the
+// page u. It covers everything the rewrite depends on: the body, the status and headers the
+// conditions of the rule may check, the rule and the settings of the proxy that are
+// written into pages.
+func rewrittenKey(u *url.URL, resp *http.Response, body []byte, rule ruleset.Rule) (string, error) {
+	ruleJSON, err := json.Marshal(rule)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "rewritten %s %s %s\n%d\n", u, basePath, clientRuntime, resp.StatusCode)
+	h.Write(ruleJSON)
+	header := resp.Header.Clone()
+	for _, name := range []string{"Date", "Age", "Expires", "Content-Length"} {
+		header.Del(name)
+	}
+	writeHeader(h, header)
+	h.Write(body)
+
+	return cacheKey(u.String(), h.Sum(nil)), nil
+}
+
+// cacheKey builds a cache key that starts with the hash of the URL, so all entries of a
+// URL can be purged together.
+func cacheKey(url string, digest []byte) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:8]) + "-" + hex.EncodeToString(digest[:16])
+}
+
+func writeHeader(w io.Writer, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%s: %q\n", name, header[name])
+	}
+}
+
+// responseCache is the memory tier and the optional disk tier of the response cache.
+type responseCache struct {
+	mu     sync.Mutex
+	memory *lru
+	disk   *lru // nil without a cache directory
+	dir    string
+}
+
+// newResponseCache creates a response cache with the sizes of its tiers in bytes. The disk
+// tier is only used if dir is set, and picks up the entries already in it.
+func newResponseCache(memorySize int64, dir string, diskSize int64) (*responseCache, error) {
+	c := &responseCache{memory: newLRU(memorySize, nil), dir: dir}
+	if dir == "" {
+		return c, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c.disk = newLRU(diskSize, func(key string) {
+		os.Remove(filepath.Join(dir, key))
+	})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			files = append(files, info)
+		}
+	}
+	// the most recently written entries are kept if the directory is over its size
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, info := range files {
+		c.disk.add(info.Name(), nil, info.Size())
+	}
+
+	return c, nil
+}
+
+// get returns the entry with the key, from memory or from disk, or nil if there is none.
+// Entries are shared and must not be modified.
+func (c *responseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	if e, ok := c.memory.get(key); ok {
+		c.mu.Unlock()
+		return e.(*cacheEntry)
+	}
+	_, onDisk := c.disk.get(key)
+	c.mu.Unlock()
+
+	if !onDisk {
+		return nil
+	}
+
+	e, err := c.readFile(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.disk.remove(key)
+		return nil
+	}
+	c.memory.add(key, e, e.size())
+
+	return e
+}
+
+// put stores an entry in both tiers.
+func (c *responseCache) put(key string, e *cacheEntry) {
+	c.mu.Lock()
+	c.memory.add(key, e, e.size())
+	c.mu.Unlock()
+
+	if c.disk == nil {
+		return
+	}
+
+	size, err := c.writeFile(key, e)
+	if err != nil {
+		log.Println("ERROR: cache:", err)
+		return
+	}
+
+	c.mu.Lock()
+	c.disk.add(key, nil, size)
+	c.mu.Unlock()
+}
+
+// purge removes the entries of a URL from both tiers, or all entries if url is empty,
+// and returns how many it removed.
+func (c *responseCache) purge(url string) int {
+	prefix := ""
+	if url != "" {
+		prefix = cacheKey(url, make([]byte, 16))[:16]
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// entries in memory are also on disk, they are only counted once
+	removed := map[string]bool{}
+	for _, key := range c.memory.removePrefix(prefix) {
+		removed[key] = true
+	}
+	if c.disk != nil {
+		for _, key := range c.disk.removePrefix(prefix) {
+			removed[key] = true
+		}
+	}
+
+	return len(removed)
+}
+
+func (c *responseCache) readFile(key string) (*cacheEntry, error) {
+	f, err := os.Open(filepath.Join(c.dir, key))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var e cacheEntry
+	if err := gob.NewDecoder(f).Decode(&e); err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// writeFile writes an entry to a temporary file first, so readers never see a partial entry.
+func (c *responseCache) writeFile(key string, e *cacheEntry) (int64, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	return int64(buf.Len()), os.Rename(tmp.Name(), filepath.Join(c.dir, key))
+}
+
+// store puts the upstream response to a request that was sent for the cached entry (nil if
+// there is none) into the cache and returns the response to use. A 304 Not Modified refreshes
+// the entry, other responses replace it once their body was read, if they may be stored.
+func (c *responseCache) store(key string, entry *cacheEntry, resp *http.Response, rule ruleset.Rule) (*http.Response, error) {
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		resp.Body.Close()
+
+		refreshed := *entry
+		refreshed.Header = entry.Header.Clone()
+		for name, values := range resp.Header {
+			if _, managed := managedResponseHeaders[name]; !managed {
+				refreshed.Header[name] = values
+			}
+		}
+		refreshed.Stored = time.Now()
+		refreshed.Age = responseAge(resp.Header, refreshed.Stored)
+		c.put(key, &refreshed)
+
+		return refreshed.cachedResponse(resp.Request), nil
+	}
+
+	if _, ok := cachePolicy(resp.StatusCode, resp.Header, time.Now(), rule); !ok {
+		return resp, nil
+	}
+
+	// the pipeline modifies the headers of the response before it reads the body
+	status, header := resp.StatusCode, resp.Header.Clone()
+
+	// redirects are stored right away, fetchSite does not read their bodies
+	if redirectLocation(resp) != nil {
+		body, err := readBody(resp)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		c.put(key, newCacheEntry(status, header, body))
+
+		return resp, nil
+	}
+
+	resp.Body = &bufferingBody{
+		ReadCloser: resp.Body,
+		limit:      maxBodySize,
+		done: func(body []byte, ok bool) {
+			if ok {
+				c.put(key, newCacheEntry(status, header, body))
+			}
+		},
+	}
+
+	return resp, nil
+}
+
+// rewrite runs rewriteResponse through the rewritten tier of the cache. Bodies of responses
+// that may not be stored are rewritten every time.
+func (c *responseCache) rewrite(bodyB []byte, u *url.URL, resp *http.Response, rule ruleset.Rule, matcher *ruleset.Matcher) (string, error) {
+	if _, ok := cachePolicy(resp.StatusCode, resp.Header, time.Now(), rule); !ok {
+		return rewriteResponse(bodyB, u, resp, rule, matcher)
+	}
+
+	key, err := rewrittenKey(u, resp, bodyB, rule)
+	if err != nil {
+		return rewriteResponse(bodyB, u, resp, rule, matcher)
+	}
+	if e := c.get(key); e != nil {
+		return string(e.Body), nil
+	}
+
+	body, err := rewriteResponse(bodyB, u, resp, rule, matcher)
+	if err != nil {
+		return "", err
+	}
+	c.put(key, &cacheEntry{Body: []byte(body), Stored: time.Now()})
+
+	return body, nil
+}
+
+// AdminPurgeCache removes the cached responses and rewritten bodies of the URL in the `url`
+// query parameter, the upstream URL or the URL of the page, or of all URLs without it.
+func AdminPurgeCache(c *fiber.Ctx) error {
+	if responses == nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return c.SendString("Cache Disabled")
+	}
+
+	return c.JSON(fiber.Map{
+		"purged": responses.purge(c.Query("url")),
+	})
+}
+
+// lru tracks the entries of a cache tier by size and evicts the least recently used ones
+// once the tier is over its limit.
+type lru struct {
+	limit   int64
+	size    int64
+	order   *list.List // most recently used first
+	items   map[string]*list.Element
+	onEvict func(key string)
+}
+
+type lruItem struct {
+	key   string
+	value any
+	size  int64
+}
+
+func newLRU(limit int64, onEvict func(key string)) *lru {
+	return &lru{limit: limit, order: list.New(), items: map[string]*list.Element{}, onEvict: onEvict}
+}
+
+// get returns the value of a key and marks it as recently used. It is nil-safe, for tiers
+// that are not used.
+func (l *lru) get(key string) (any, bool) {
+	if l == nil {
+		return nil, false
+	}
+
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+
+	return el.Value.(*lruItem).value, true
+}
+
+// add adds or replaces the value of a key. Values larger than the limit are not added.
+func (l *lru) add(key string, value any, size int64) {
+	if el, ok := l.items[key]; ok {
+		l.size -= el.Value.(*lruItem).size
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+	if size > l.limit {
+		if l.onEvict != nil {
+			l.onEvict(key)
+		}
+		return
+	}
+
+	l.items[key] = l.order.PushFront(&lruItem{key: key, value: value, size: size})
+	l.size += size
+
+	for l.size > l.limit {
+		l.remove(l.order.Back().Value.(*lruItem).key)
+	}
+}
+
+// remove removes a key and reports whether it was there.
+func (l *lru) remove(key string) bool {
+	el, ok := l.items[key]
+	if !ok {
+		return false
+	}
+
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem).size
+	if l.onEvict != nil {
+		l.onEvict(key)
+	}
+
+	return true
+}
+
+// removePrefix removes the keys with the prefix and returns them.
+func (l *lru) removePrefix(prefix string) []string {
+	var keys []string
+	for key := range l.items {
+		if strings.HasPrefix(key, prefix) && l.remove(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePolicy(t *testing.T) {
+	now := time.Now()
+	date := now.UTC().Format(http.TimeFormat)
+
+	testCases := []struct {
+		name     string
+		status   int
+		header   http.Header
+		rule     string
+		lifetime time.Duration
+		storable bool
+	}{
+		{"max-age", 200, http.Header{"Cache-Control": {"public, max-age=60"}}, "", time.Minute, true},
+		{"s-maxage wins", 200, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, "", 2 * time.Minute, true},
+		{"no-store", 200, http.Header{"Cache-Control": {"no-store"}}, "", 0, false},
+		{"private", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, "", 0, false},
+		{"no-cache with etag", 200, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}, "", 0, true},
+		{"no-cache without validator", 200, http.Header{"Cache-Control": {"no-cache"}}, "", 0, false},
+		{"expires", 200, http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).UTC().Format(http.TimeFormat)}}, "", time.Hour, true},
+		{"heuristic", 200, http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).UTC().Format(http.TimeFormat)}}, "", time.Hour, true},
+		{"no headers", 200, http.Header{}, "", 0, false},
+		{"set-cookie", 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=b"}}, "", 0, false},
+		{"vary *", 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, "", 0, false},
+		{"server error", 500, http.Header{"Cache-Control": {"max-age=60"}}, "", 0, false},
+		{"found needs explicit freshness", 302, http.Header{"Last-Modified": {date}}, "", 0, false},
+		{"rule ttl", 200, http.Header{"Cache-Control": {"no-store"}}, "cache: {ttl: 5m}", 5 * time.Minute, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lifetime, storable := cachePolicy(tc.status, tc.header, now, testRule(t, tc.rule))
+			assert.Equal(t, tc.storable, storable)
+			assert.Equal(t, tc.lifetime, lifetime.Round(time.Second))
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		hits   = map[string]int{}
+		notMod int
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				mu.Lock()
+				notMod++
+				mu.Unlock()
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/image":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<html><head></head><body><p class="x">` + r.URL.Path + `</p></body></html>`))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	writeRules := func(rules string) string {
+		path := filepath.Join(dir, "rules.yaml")
+		os.WriteFile(path, []byte(rules), 0o644)
+		return path
+	}
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+	defer func(c *responseCache) { responses = c }(responses)
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "secret"
+
+	cache, err := newResponseCache(1<<20, filepath.Join(dir, "cache"), 1<<20)
+	assert.NoError(t, err)
+	responses = cache
+
+	app := fiber.New()
+	app.Delete("/admin/cache", AdminAuth, AdminPurgeCache)
+	app.Get("/*", ProxySite(writeRules(`
+- domain: 127.0.0.1
+  paths:
+    - /ttl
+  cache:
+    ttl: 1m
+`)))
+
+	get := func(path string) string {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+path, nil))
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+
+	for _, path := range []string{"/fresh", "/etag", "/no-store", "/ttl", "/image"} {
+		first := get(path)
+		assert.Equal(t, first, get(path), path)
+	}
+	assert.Equal(t, 1, count("/fresh"))
+	assert.Equal(t, 1, count("/ttl"))
+	assert.Equal(t, 1, count("/image"))
+	assert.Equal(t, 2, count("/no-store"))
+	// stale responses are revalidated
+	assert.Equal(t, 2, count("/etag"))
+	assert.Equal(t, 1, notMod)
+
+	// a rule change invalidates the rewritten bodies, not the upstream responses
+	ProxySite(writeRules(`
+- domain: 127.0.0.1
+  injections:
+    - position: p.x
+      setText: changed
+`))
+	assert.Contains(t, get("/fresh"), `<p class="x">changed</p>`)
+	assert.Equal(t, 1, count("/fresh"))
+
+	// the disk tier survives a restart
+	responses, err = newResponseCache(1<<20, filepath.Join(dir, "cache"), 1<<20)
+	assert.NoError(t, err)
+	assert.Contains(t, get("/fresh"), `<p class="x">changed</p>`)
+	assert.Equal(t, 1, count("/fresh"))
+
+	// purging a URL removes its entries from both tiers
+	req := httptest.NewRequest(http.MethodDelete, "/admin/cache?url="+upstream.URL+"/fresh", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, `{"purged":3}`, string(body))
+
+	get("/fresh")
+	assert.Equal(t, 2, count("/fresh"))
+	get("/image")
+	assert.Equal(t, 1, count("/image"))
+}
+
+func TestLRU(t *testing.T) {
+	var evicted []string
+	l := newLRU(10, func(key string) { evicted = append(evicted, key) })
+
+	l.add("a", 1, 4)
+	l.add("b", 2, 4)
+	l.get("a")
+	l.add("c", 3, 4)
+	assert.Equal(t, []string{"b"}, evicted)
+
+	_, ok := l.get("a")
+	assert.True(t, ok)
+	l.add("d", 4, 11)
+	assert.Equal(t, []string{"b", "d"}, evicted)
+	assert.Equal(t, int64(8), l.size)
+}
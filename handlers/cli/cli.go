@@ -1,6 +1,8 @@
 package cli
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -15,11 +17,13 @@ import (
 // - rulesetPath: Specifies the path to the ruleset file.
 // - mergeRulesets: Indicates if a merge operation should be performed.
 // - useGzip: Indicates if the merged rulesets should be gzip-ped.
+// - keepReferences: Indicates if fragments, `extends` and `include` should be kept instead of resolved.
+// - signingKey: Specifies a private key file. If set, a detached signature is written to the output file with a .sig suffix.
 // - output: Specifies the output file. If nil, stdout will be used.
 //
 // Returns:
 // - An error if the ruleset loading or merging process fails, otherwise nil.
-func HandleRulesetMerge(rulesetPath string, mergeRulesets bool, useGzip bool, output *os.File) error {
+func HandleRulesetMerge(rulesetPath string, mergeRulesets bool, useGzip bool, keepReferences bool, signingKey string, output *os.File) error {
 	if !mergeRulesets {
 		return nil
 	}
@@ -33,12 +37,21 @@ func HandleRulesetMerge(rulesetPath string, mergeRulesets bool, useGzip bool, ou
 		os.Exit(1)
 	}
 
-	rs, err := ruleset.NewRuleset(rulesetPath)
+	load := ruleset.NewRuleset
+	if keepReferences {
+		load = ruleset.NewRulesetUnresolved
+	}
+
+	rs, err := load(rulesetPath)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
+	if signingKey != "" {
+		return signedMerge(rs, useGzip, signingKey, output)
+	}
+
 	if useGzip {
 		return gzipMerge(rs, output)
 	}
@@ -46,6 +59,49 @@ func HandleRulesetMerge(rulesetPath string, mergeRulesets bool, useGzip bool, ou
 	return yamlMerge(rs, output)
 }
 
+// signedMerge writes the merged RuleSet to the output file and signs it with the private key in signingKey.
+// The signature is written next to the output file with a .sig suffix.
+//
+// Parameters:
+// - rs: The ruleset.RuleSet to be merged.
+// - useGzip: Indicates if the merged rulesets should be gzip-ped.
+// - signingKey: Specifies the private key file.
+// - output: The output file. Signing requires a file, not stdout.
+//
+// Returns:
+// - An error if merging, signing or writing fails, otherwise nil.
+func signedMerge(rs ruleset.RuleSet, useGzip bool, signingKey string, output *os.File) error {
+	if output == nil || output == os.Stdout {
+		return errors.New("--merge-rulesets-sign requires --merge-rulesets-output")
+	}
+
+	privateKey, err := os.ReadFile(signingKey)
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if useGzip {
+		err = gzipMerge(rs, &buf)
+	} else {
+		err = yamlMerge(rs, &buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	signature, err := ruleset.Sign(buf.Bytes(), string(privateKey))
+	if err != nil {
+		return err
+	}
+
+	if _, err := output.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write merged ruleset: %v", err)
+	}
+
+	return os.WriteFile(output.Name()+".sig", []byte(signature+"\n"), 0o644)
+}
+
 // gzipMerge takes a RuleSet and an output writer. It compresses the RuleSet into Gzip format and writes it to the output.
 //
 // Parameters:
@@ -0,0 +1,56 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"ladder/pkg/ruleset"
+)
+
+// HandleRulesetKeygen generates a key pair for signing rulesets. The private key is written to keyPath,
+// the public key to keyPath.pub and printed, so it can be added to RULESET_PUBLIC_KEYS.
+//
+// Parameters:
+// - keyPath: Specifies the file for the private key. Existing files are not overwritten.
+// - output: Specifies the output for the public key.
+//
+// Returns:
+// - The exit code: 0 on success, 1 if the keys could not be written.
+func HandleRulesetKeygen(keyPath string, output io.Writer) int {
+	publicKey, privateKey, err := ruleset.GenerateKey()
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return 1
+	}
+
+	if err := writeNewFile(keyPath, privateKey+"\n", 0o600); err != nil {
+		fmt.Fprintln(output, err)
+		return 1
+	}
+
+	if err := writeNewFile(keyPath+".pub", publicKey+"\n", 0o644); err != nil {
+		fmt.Fprintln(output, err)
+		return 1
+	}
+
+	fmt.Fprintf(output, "private key written to %s, keep it secret\n", keyPath)
+	fmt.Fprintf(output, "public key: %s\n", publicKey)
+
+	return 0
+}
+
+// writeNewFile writes content to a file that must not exist yet.
+func writeNewFile(path string, content string, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(f, content); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
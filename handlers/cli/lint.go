@@ -0,0 +1,55 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"ladder/pkg/ruleset"
+)
+
+// HandleRulesetLint lints a set of local ruleset files, specified by the rulesetPath or RULESET env variable,
+// and prints one `file:line: severity: message` diagnostic per problem.
+//
+// Parameters:
+// - rulesetPath: Specifies the path to the ruleset file or directory.
+// - strict: Indicates if warnings should fail the lint as well as errors.
+// - output: Specifies the output for the diagnostics.
+//
+// Returns:
+// - The exit code: 0 if the ruleset is valid, 1 if problems were found, 2 if the ruleset could not be read.
+func HandleRulesetLint(rulesetPath string, strict bool, output io.Writer) int {
+	if rulesetPath == "" {
+		rulesetPath = os.Getenv("RULESET")
+	}
+
+	if rulesetPath == "" {
+		fmt.Fprintln(output, "error: no ruleset provided. Try again with --ruleset <ruleset.yaml>")
+		return 2
+	}
+
+	diags, err := ruleset.Lint(rulesetPath)
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return 2
+	}
+
+	errors, warnings := 0, 0
+	for _, d := range diags {
+		fmt.Fprintln(output, d)
+
+		if d.Severity == ruleset.SeverityError {
+			errors++
+		} else {
+			warnings++
+		}
+	}
+
+	fmt.Fprintf(output, "%d errors, %d warnings\n", errors, warnings)
+
+	if errors > 0 || (strict && warnings > 0) {
+		return 1
+	}
+
+	return 0
+}
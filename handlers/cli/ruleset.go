@@ -0,0 +1,60 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/akamensky/argparse"
+)
+
+// HandleRulesetCommand runs the `ladder ruleset <command>` utility commands.
+//
+// Parameters:
+// - args: The command line arguments, starting with the program name.
+//
+// Returns:
+// - The exit code for the program.
+func HandleRulesetCommand(args []string) int {
+	parser := argparse.NewParser("ladder", "Every Wall needs a Ladder")
+	rulesetCmd := parser.NewCommand("ruleset", "Utilities for writing and checking rulesets")
+
+	lintCmd := rulesetCmd.NewCommand("lint", "Checks rulesets for unknown fields, invalid regexes and selectors, empty rules and duplicate domains")
+	lintRuleset := lintCmd.String("r", "ruleset", &argparse.Options{
+		Required: false,
+		Help:     "File or Directory of a ruleset.yaml, separated by semicolons. Overrides RULESET environment variable.",
+	})
+	lintStrict := lintCmd.Flag("", "strict", &argparse.Options{
+		Required: false,
+		Help:     "Exit with a non-zero code on warnings, not only on errors.",
+	})
+
+	testCmd := rulesetCmd.NewCommand("test", "Runs the tests of every rule against their fixtures offline")
+	testRuleset := testCmd.String("r", "ruleset", &argparse.Options{
+		Required: false,
+		Help:     "File or Directory of a ruleset.yaml, separated by semicolons. Overrides RULESET environment variable.",
+	})
+
+	keygenCmd := rulesetCmd.NewCommand("keygen", "Generates a key pair for signing rulesets with --merge-rulesets-sign")
+	keygenOutput := keygenCmd.String("o", "output", &argparse.Options{
+		Required: false,
+		Default:  "ruleset.key",
+		Help:     "File for the private key. The public key is written next to it with a .pub suffix.",
+	})
+
+	err := parser.Parse(args)
+	if err != nil {
+		fmt.Print(parser.Usage(err))
+		return 2
+	}
+
+	switch {
+	case lintCmd.Happened():
+		return HandleRulesetLint(*lintRuleset, *lintStrict, os.Stdout)
+	case testCmd.Happened():
+		return HandleRulesetTest(*testRuleset, os.Stdout)
+	case keygenCmd.Happened():
+		return HandleRulesetKeygen(*keygenOutput, os.Stdout)
+	}
+
+	return 0
+}
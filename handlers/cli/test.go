@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"ladder/handlers"
+	"ladder/pkg/ruleset"
+)
+
+// HandleRulesetTest runs the `tests` of every rule in a ruleset, specified by the rulesetPath or RULESET env variable,
+// against their fixtures offline and prints a pass/fail report.
+//
+// Parameters:
+// - rulesetPath: Specifies the path to the ruleset file or directory.
+// - output: Specifies the output for the report.
+//
+// Returns:
+// - The exit code: 0 if all tests passed, 1 if a test failed, 2 if the ruleset could not be loaded.
+func HandleRulesetTest(rulesetPath string, output io.Writer) int {
+	if rulesetPath == "" {
+		rulesetPath = os.Getenv("RULESET")
+	}
+
+	if rulesetPath == "" {
+		fmt.Fprintln(output, "error: no ruleset provided. Try again with --ruleset <ruleset.yaml>")
+		return 2
+	}
+
+	rs, err := ruleset.NewRuleset(rulesetPath)
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return 2
+	}
+
+	results, err := handlers.RunRuleTests(rs)
+	if err != nil {
+		fmt.Fprintln(output, err)
+		return 2
+	}
+
+	passed, failed := 0, 0
+	for _, result := range results {
+		if result.Passed() {
+			passed++
+			fmt.Fprintf(output, "PASS %s\n", result.Name)
+
+			continue
+		}
+
+		failed++
+		fmt.Fprintf(output, "FAIL %s\n", result.Name)
+		for _, failure := range result.Failures {
+			fmt.Fprintf(output, "     - %s\n", failure)
+		}
+	}
+
+	fmt.Fprintf(output, "%d passed, %d failed\n", passed, failed)
+
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
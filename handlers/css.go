@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"ladder/pkg/ruleset"
+)
+
+// rewriteCss rewrites every URL reference of a stylesheet, a <style> block or a style attribute
+// into the proxy URL space, resolved against base: url() tokens, the strings of @import rules
+// and of image-set(). The stylesheet is tokenized, so comments and other strings are left alone,
+// and everything except the rewritten URLs is kept byte for byte.
+func rewriteCss(css string, base *url.URL, matcher *ruleset.Matcher) string {
+	var out strings.Builder
+	out.Grow(len(css))
+
+	var funcs []string // names of the open functions, "" for plain parentheses
+	importing := false // after @import, until its URL or the end of the rule
+
+	for i := 0; i < len(css); {
+		c := css[i]
+
+		switch {
+		case strings.HasPrefix(css[i:], "/*"):
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				out.WriteString(css[i:])
+				return out.String()
+			}
+			end += i + 4
+			out.WriteString(css[i:end])
+			i = end
+		case c == '"' || c == '\'':
+			value, end := readCssString(css, i)
+			if importing || inImageSet(funcs) {
+				writeCssUrl(&out, css[i:end], value, c, base, matcher)
+				importing = false
+			} else {
+				out.WriteString(css[i:end])
+			}
+			i = end
+		case c == '\\' && i+1 < len(css):
+			_, size := utf8.DecodeRuneInString(css[i+1:])
+			out.WriteString(css[i : i+1+size])
+			i += 1 + size
+		case c == '@':
+			name, end := readCssIdent(css, i+1)
+			importing = strings.EqualFold(name, "import")
+			out.WriteString(css[i:end])
+			i = end
+		case c == ';' || c == '{' || c == '}':
+			importing = false
+			out.WriteByte(c)
+			i++
+		case c == '(':
+			funcs = append(funcs, "")
+			out.WriteByte(c)
+			i++
+		case c == ')':
+			if len(funcs) > 0 {
+				funcs = funcs[:len(funcs)-1]
+			}
+			out.WriteByte(c)
+			i++
+		case isCssNameStart(c):
+			name, end := readCssIdent(css, i)
+			if end == i {
+				out.WriteByte(c)
+				i++
+				continue
+			}
+
+			if end >= len(css) || css[end] != '(' {
+				out.WriteString(css[i:end])
+				i = end
+				continue
+			}
+
+			fn := strings.ToLower(name)
+			if fn == "url" {
+				if raw, value, quote, urlEnd, ok := readCssUrl(css, end+1); ok {
+					out.WriteString(css[i : end+1])
+					writeCssUrl(&out, raw, value, quote, base, matcher)
+					out.WriteByte(')')
+					importing = false
+					i = urlEnd
+					continue
+				}
+			}
+
+			funcs = append(funcs, fn)
+			out.WriteString(css[i : end+1])
+			i = end + 1
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+
+	return out.String()
+}
+
+// writeCssUrl writes a rewritten URL. raw is the URL as written in the stylesheet, including
+// its quotes, value the unescaped URL and quote the quote character, or 0 for url(unquoted).
+// URLs that are not rewritten, such as data: URLs, are written as they were.
+func writeCssUrl(out *strings.Builder, raw string, value string, quote byte, base *url.URL, matcher *ruleset.Matcher) {
+	rewritten := rewriteUrl(value, base, matcher)
+	if rewritten == value {
+		out.WriteString(raw)
+		return
+	}
+
+	out.WriteString(quoteCss(rewritten, quote))
+}
+
+// readCssString reads the string starting with the quote at css[start]. It returns the unescaped
+// value and the index after the closing quote, or after the end of the line of an unclosed string.
+func readCssString(css string, start int) (string, int) {
+	quote := css[start]
+
+	var value strings.Builder
+
+	for i := start + 1; i < len(css); i++ {
+		switch c := css[i]; c {
+		case quote:
+			return value.String(), i + 1
+		case '\n':
+			return value.String(), i
+		case '\\':
+			r, end := readCssEscape(css, i)
+			value.WriteString(r)
+			i = end - 1
+		default:
+			value.WriteByte(c)
+		}
+	}
+
+	return value.String(), len(css)
+}
+
+// readCssUrl reads the arguments of url( starting at css[start]. It returns the URL as written,
+// the unescaped URL, its quote character, or 0 if it is unquoted, and the index after the
+// closing parenthesis. ok is false if the arguments are not a single URL.
+func readCssUrl(css string, start int) (raw string, value string, quote byte, end int, ok bool) {
+	i := skipCssSpace(css, start)
+	if i >= len(css) {
+		return "", "", 0, 0, false
+	}
+
+	if c := css[i]; c == '"' || c == '\'' {
+		value, strEnd := readCssString(css, i)
+		j := skipCssSpace(css, strEnd)
+		if j >= len(css) || css[j] != ')' {
+			return "", "", 0, 0, false
+		}
+
+		return css[i:strEnd], value, c, j + 1, true
+	}
+
+	var b strings.Builder
+
+	for j := i; j < len(css); j++ {
+		switch c := css[j]; {
+		case c == ')':
+			return css[i:j], b.String(), 0, j + 1, true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			k := skipCssSpace(css, j)
+			if k < len(css) && css[k] == ')' {
+				return css[i:j], b.String(), 0, k + 1, true
+			}
+			return "", "", 0, 0, false
+		case c == '"' || c == '\'' || c == '(':
+			return "", "", 0, 0, false
+		case c == '\\':
+			r, escEnd := readCssEscape(css, j)
+			b.WriteString(r)
+			j = escEnd - 1
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", "", 0, 0, false
+}
+
+// readCssEscape reads the escape sequence starting with the backslash at css[start] and returns
+// the escaped character and the index after the sequence.
+func readCssEscape(css string, start int) (string, int) {
+	i := start + 1
+	if i >= len(css) {
+		return "", i
+	}
+
+	hex := i
+	for hex < len(css) && hex-i < 6 && isHexDigit(css[hex]) {
+		hex++
+	}
+
+	if hex == i {
+		if css[i] == '\n' {
+			return "", i + 1 // escaped newline in a string continues the string
+		}
+		_, size := utf8.DecodeRuneInString(css[i:])
+		return css[i : i+size], i + size
+	}
+
+	code, _ := strconv.ParseUint(css[i:hex], 16, 32)
+	if hex < len(css) && (css[hex] == ' ' || css[hex] == '\t' || css[hex] == '\n') {
+		hex++
+	}
+	if code == 0 || code > utf8.MaxRune {
+		code = utf8.RuneError
+	}
+
+	return string(rune(code)), hex
+}
+
+// readCssIdent reads the identifier starting at css[start] and returns it and the index after it.
+func readCssIdent(css string, start int) (string, int) {
+	i := start
+	for i < len(css) {
+		c := css[i]
+		if isCssNameStart(c) || (c >= '0' && c <= '9') {
+			i++
+			continue
+		}
+		if c == '\\' && i+1 < len(css) && css[i+1] != '\n' {
+			_, end := readCssEscape(css, i)
+			i = end
+			continue
+		}
+		break
+	}
+
+	return css[start:i], i
+}
+
+// quoteCss quotes a URL for a stylesheet. Unquoted URLs (quote 0) stay unquoted unless they
+// contain characters that are not allowed in url(unquoted).
+func quoteCss(s string, quote byte) string {
+	if quote == 0 {
+		if !strings.ContainsAny(s, "\"'()\\ \t\n\r\f") {
+			return s
+		}
+		quote = '"'
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, string(quote), `\`+string(quote), "\n", `\a `)
+
+	return string(quote) + r.Replace(s) + string(quote)
+}
+
+// inImageSet reports whether the innermost open function is image-set(), whose strings are URLs.
+func inImageSet(funcs []string) bool {
+	if len(funcs) == 0 {
+		return false
+	}
+
+	fn := funcs[len(funcs)-1]
+
+	return fn == "image-set" || fn == "-webkit-image-set"
+}
+
+func skipCssSpace(css string, i int) int {
+	for i < len(css) && strings.IndexByte(" \t\n\r\f", css[i]) >= 0 {
+		i++
+	}
+
+	return i
+}
+
+func isCssNameStart(c byte) bool {
+	return c == '-' || c == '_' || c >= 0x80 || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteCss(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com:8443/assets/css/site.css")
+
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{`a { background: url(img/bg.png) }`, `a { background: url(/https://cdn.example.com:8443/assets/css/img/bg.png) }`},
+		{`a { background: url( "../img/bg.png" ) }`, `a { background: url("/https://cdn.example.com:8443/assets/img/bg.png") }`},
+		{`a { background: URL('/bg.png') }`, `a { background: URL('/https://cdn.example.com:8443/bg.png') }`},
+		{`@import "reset.css";`, `@import "/https://cdn.example.com:8443/assets/css/reset.css";`},
+		{`@import url(print.css) print;`, `@import url(/https://cdn.example.com:8443/assets/css/print.css) print;`},
+		{`@font-face { src: url(../fonts/a.woff2) format("woff2"), url('//fonts.example.org/a.woff') }`,
+			`@font-face { src: url(/https://cdn.example.com:8443/assets/fonts/a.woff2) format("woff2"), url('/https://fonts.example.org/a.woff') }`},
+		{`a { background: image-set("a.png" 1x, "a-2x.png" 2x) }`,
+			`a { background: image-set("/https://cdn.example.com:8443/assets/css/a.png" 1x, "/https://cdn.example.com:8443/assets/css/a-2x.png" 2x) }`},
+		{`a { content: "url(x.png)"; font-family: "Open Sans" }`, `a { content: "url(x.png)"; font-family: "Open Sans" }`},
+		{`/* url(x.png) @import "y.css"; */`, `/* url(x.png) @import "y.css"; */`},
+		{`a { background: url(data:image/png;base64,AAAA) }`, `a { background: url(data:image/png;base64,AAAA) }`},
+		{`a { background: url(#svg-filter) }`, `a { background: url(#svg-filter) }`},
+		{`a { background: url(a\(1\).png) }`, `a { background: url("/https://cdn.example.com:8443/assets/css/a(1).png") }`},
+		{`a { --icon: url(icon.svg); width: calc(100% - 10px) }`, `a { --icon: url(/https://cdn.example.com:8443/assets/css/icon.svg); width: calc(100% - 10px) }`},
+		{`a { background: url(unclosed`, `a { background: url(unclosed`},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, rewriteCss(tc.in, base, nil), tc.in)
+	}
+}
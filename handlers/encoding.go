@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/html/charset"
+)
+
+// acceptEncoding is the Accept-Encoding sent upstream. Every encoding in it is decoded by
+// decodeContentEncoding, for the bodies that are rewritten and the clients that do not
+// accept the encoding of a streamed body.
+const acceptEncoding = "gzip, br, zstd, deflate"
+
+var cssCharsetRegex = regexp.MustCompile(`^(\x{FEFF}?@charset\s*)"([^"]*)"`)
+
+// decodingBody decodes an upstream body with the decoder of its Content-Encoding.
+// The decoder is created on the first read, so empty bodies need no valid header.
+type decodingBody struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.ReadCloser, error)
+	r         io.ReadCloser
+	err       error
+}
+
+func (d *decodingBody) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.newReader(d.body)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+
+	return d.r.Read(p)
+}
+
+func (d *decodingBody) Close() error {
+	if d.r != nil {
+		d.r.Close()
+	}
+
+	return d.body.Close()
+}
+
+// decoders create the readers of the content codings in acceptEncoding.
+var decoders = map[string]func(io.Reader) (io.ReadCloser, error){
+	"gzip":   func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	"x-gzip": func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	"br":     func(r io.Reader) (io.ReadCloser, error) { return io.NopCloser(brotli.NewReader(r)), nil },
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	},
+	"deflate": func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) },
+}
+
+// decodeContentEncoding replaces the body of an upstream response with its decoded content
+// and removes the Content-Encoding. Codings applied one after another are decoded in reverse.
+// The body is decoded while it is read, so it can still be streamed.
+func decodeContentEncoding(resp *http.Response) error {
+	header := resp.Header.Get("Content-Encoding")
+	if header == "" {
+		return nil
+	}
+
+	codings := strings.Split(header, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(strings.TrimSpace(codings[i]))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+
+		newReader, ok := decoders[coding]
+		if !ok {
+			return fmt.Errorf("unsupported content encoding '%s' from %s", coding, resp.Request.URL)
+		}
+		resp.Body = &decodingBody{body: resp.Body, newReader: newReader}
+	}
+
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+
+	return nil
+}
+
+// acceptsEncoding reports whether a client with the Accept-Encoding accept can read a body
+// with the Content-Encoding contentEncoding as it is, which requires every one of its codings.
+func acceptsEncoding(accept, contentEncoding string) bool {
+	qualities := map[string]string{}
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := "1"
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			q = strings.TrimSpace(value)
+		}
+		qualities[strings.ToLower(strings.TrimSpace(coding))] = q
+	}
+
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+
+		q, ok := qualities[coding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if !ok || strings.Trim(q, "0.") == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeCharset transcodes an upstream body that is about to be rewritten to UTF-8 and sets
+// the charset of its Content-Type to utf-8. The charset is taken from the byte order mark,
+// the Content-Type header and, for HTML, <meta charset>, or @charset for CSS. Bodies without
+// a declared charset are UTF-8 if they are valid UTF-8. For HTML, they are windows-1252
+// otherwise, like in browsers. rewriteHtml updates the <meta charset> of the transcoded document.
+// contentType is the Content-Type of the body, sniffed if the upstream did not send one.
+func decodeCharset(body []byte, resp *http.Response, contentType string) []byte {
+	html, css := isHtml(contentType), isCss(contentType)
+
+	enc, name, certain := charset.DetermineEncoding(body, resp.Header.Get("Content-Type"))
+	if css && !certain {
+		if m := cssCharsetRegex.FindSubmatch(body); m != nil {
+			enc, name = charset.Lookup(string(m[2]))
+			certain = enc != nil
+		}
+	}
+	if !certain && !html {
+		return body
+	}
+	if enc == nil || name == "utf-8" || (!certain && utf8.Valid(body)) {
+		return body
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body
+	}
+	decoded = bytes.TrimPrefix(decoded, []byte("\uFEFF"))
+
+	if mediaType, params, err := mime.ParseMediaType(contentType); err == nil {
+		params["charset"] = "utf-8"
+		resp.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+
+	if css {
+		decoded = cssCharsetRegex.ReplaceAll(decoded, []byte(`${1}"utf-8"`))
+	}
+
+	return decoded
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+)
+
+func TestProxySiteDecodesBodies(t *testing.T) {
+	page := []byte(`<html><head><meta charset="utf-8"></head><body><a href="/next">next</a></body></html>`)
+
+	encoded := map[string][]byte{}
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(page)
+	gw.Close()
+	encoded["gzip"] = gz.Bytes()
+
+	var br bytes.Buffer
+	bw := brotli.NewWriter(&br)
+	bw.Write(page)
+	bw.Close()
+	encoded["br"] = br.Bytes()
+
+	zw, _ := zstd.NewWriter(nil)
+	encoded["zstd"] = zw.EncodeAll(page, nil)
+
+	var both bytes.Buffer
+	bw = brotli.NewWriter(&both)
+	bw.Write(encoded["gzip"])
+	bw.Close()
+	encoded["gzip, br"] = both.Bytes()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, acceptEncoding, r.Header.Get("Accept-Encoding"))
+
+		coding := r.URL.Query().Get("coding")
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Header().Set("Content-Encoding", coding)
+		w.Write(encoded[coding])
+	}))
+	defer upstream.Close()
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	for coding := range encoded {
+		for _, contentType := range []string{"text/html", "application/octet-stream"} {
+			q := url.Values{"coding": {coding}, "type": {contentType}}
+			resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/?"+q.Encode(), nil))
+			assert.NoError(t, err)
+			assert.Empty(t, resp.Header.Get("Content-Encoding"))
+			body, _ := io.ReadAll(resp.Body)
+
+			if contentType == "text/html" {
+				assert.Contains(t, string(body), `href="/`+upstream.URL+`/next"`, coding)
+			} else {
+				assert.Equal(t, page, body, coding)
+			}
+		}
+
+		// a body that is not rewritten is passed through if the client accepts its encoding
+		q := url.Values{"coding": {coding}, "type": {"application/octet-stream"}}
+		req := httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/?"+q.Encode(), nil)
+		req.Header.Set("Accept-Encoding", "gzip, br;q=0.8, zstd")
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		assert.Equal(t, coding, resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, strconv.Itoa(len(encoded[coding])), resp.Header.Get("Content-Length"))
+		body, _ := io.ReadAll(resp.Body)
+		assert.Equal(t, encoded[coding], body, coding)
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	assert.True(t, acceptsEncoding("gzip, br", "gzip"))
+	assert.True(t, acceptsEncoding("gzip, br", "gzip, br"))
+	assert.True(t, acceptsEncoding("*", "zstd"))
+	assert.True(t, acceptsEncoding("", "identity"))
+	assert.False(t, acceptsEncoding("gzip", "gzip, br"))
+	assert.False(t, acceptsEncoding("gzip;q=0, *", "gzip"))
+	assert.False(t, acceptsEncoding("", "gzip"))
+}
+
+func TestDecodeCharset(t *testing.T) {
+	sjis, _ := japanese.ShiftJIS.NewEncoder().String(`<html><head><meta charset="Shift_JIS"><title>日本語</title></head></html>`)
+	latin1, _ := charmap.ISO8859_1.NewEncoder().String(`<html><head><meta http-equiv="Content-Type" content="text/html; charset=iso-8859-1"></head><p>Café</p></html>`)
+	css, _ := charmap.Windows1252.NewEncoder().String(`@charset "windows-1252"; .price::before { content: "€"; }`)
+
+	testCases := []struct {
+		name        string
+		header      string
+		body        string
+		contentType string
+		want        string
+	}{
+		{
+			name: "meta charset",
+			body: sjis,
+			want: `<html><head><meta charset="utf-8"><title>日本語</title></head></html>`,
+		},
+		{
+			name:   "header charset",
+			header: "text/html; charset=ISO-8859-1",
+			body:   latin1,
+			want:   `<html><head><meta http-equiv="Content-Type" content="text/html; charset=utf-8"></head><p>Café</p></html>`,
+		},
+		{
+			name: "undeclared utf-8",
+			body: `<html><p>` + string(bytes.Repeat([]byte("x"), 2000)) + `Café</p></html>`,
+			want: `<html><p>` + string(bytes.Repeat([]byte("x"), 2000)) + `Café</p></html>`,
+		},
+		{
+			name:        "css @charset",
+			body:        css,
+			contentType: "text/css",
+			want:        `@charset "utf-8"; .price::before { content: "€"; }`,
+		},
+	}
+
+	u, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}, Request: u}
+			if tc.header != "" {
+				resp.Header.Set("Content-Type", tc.header)
+			}
+			contentType := tc.header
+			if contentType == "" {
+				contentType = tc.contentType
+			}
+			if contentType == "" {
+				contentType = http.DetectContentType([]byte(tc.body))
+			}
+
+			body := decodeCharset([]byte(tc.body), resp, contentType)
+			got, err := rewriteResponse(body, u.URL, resp, testRule(t, "domain: example.com"), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Identical upstream requests that arrive while one of them is in flight are coalesced: the
+// first one is sent, and the others wait for its response instead of asking the origin, and
+// FlareSolverr, again. This happens whether or not the response cache is enabled.
+
+// flights are the coalescable upstream requests in flight.
+var flights = &flightGroup{flights: map[string]*flight{}}
+
+// flight is an upstream request in flight that identical requests wait for.
+type flight struct {
+	done chan struct{}
+	// waiting is the number of requests waiting for the flight, guarded by the flightGroup.
+	waiting int
+	// entry is the response with its whole body, nil if it could not be shared.
+	entry *cacheEntry
+	err   error
+}
+
+// flightGroup holds the upstream requests in flight by their key.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// coalescable reports whether identical upstream requests can share a response. Only GET
+// requests without a body are coalesced.
+func coalescable(req *http.Request, fwd *forwardedRequest) bool {
+	return req.Method == http.MethodGet && len(fwd.body) == 0
+}
+
+// flightKey returns the key of an upstream request: the request, including every header the
+// rule made it send, and the session of the client, whose cookies are sent and set by it.
+func flightKey(req *http.Request, fwd *forwardedRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n%p\n", req.Method, req.URL, fwd.jar)
+	writeHeader(h, req.Header)
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// do sends an upstream request with fetch, unless an identical request is in flight. Then it
+// waits for that request and returns a copy of its response. If the response cannot be
+// shared, because its body was too large or not read to the end, it is sent after all.
+//
+// Requests join a flight until its body starts being read. Only if any joined is the body
+// buffered for them, so responses nobody waits for, like most media streams, are passed
+// through without holding them in memory.
+func (g *flightGroup) do(key string, req *http.Request, fetch func() (*http.Response, error)) (*http.Response, error) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		f.waiting++
+		g.mu.Unlock()
+
+		select {
+		case <-f.done:
+		case <-req.Context().Done():
+			g.mu.Lock()
+			f.waiting--
+			g.mu.Unlock()
+			return nil, req.Context().Err()
+		}
+
+		if f.err != nil {
+			return nil, f.err
+		}
+		if f.entry != nil {
+			return f.entry.response(req), nil
+		}
+
+		return fetch()
+	}
+
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	resp, err := fetch()
+	if err != nil {
+		g.finish(key, f, nil, err)
+		return nil, err
+	}
+
+	// the status and headers are taken before the pipeline modifies them
+	status, header := resp.StatusCode, resp.Header.Clone()
+
+	// fetchSite does not read the bodies of redirects, they are read here
+	if redirectLocation(resp) != nil {
+		body, err := readBody(resp)
+		resp.Body.Close()
+		if err != nil {
+			g.finish(key, f, nil, err)
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		g.finish(key, f, newCacheEntry(status, header, body), nil)
+
+		return resp, nil
+	}
+
+	resp.Body = &flightBody{
+		ReadCloser: resp.Body,
+		begin: func(body io.ReadCloser) io.ReadCloser {
+			g.mu.Lock()
+			waiting := f.waiting
+			g.mu.Unlock()
+
+			if waiting == 0 {
+				g.finish(key, f, nil, nil)
+				return body
+			}
+
+			share := func(body []byte, ok bool) {
+				var entry *cacheEntry
+				if ok {
+					entry = newCacheEntry(status, header, body)
+				}
+				g.finish(key, f, entry, nil)
+			}
+
+			// a body the response cache buffers is shared from its buffer
+			if b, ok := body.(*bufferingBody); ok && b.done != nil {
+				b.onDone(share)
+				return b
+			}
+
+			return &bufferingBody{ReadCloser: body, limit: maxBodySize, done: share}
+		},
+	}
+
+	return resp, nil
+}
+
+// flightBody is the body of the response of a flight. When it is first read or closed, begin
+// ends the flight for new requests and returns the body to read from.
+type flightBody struct {
+	io.ReadCloser
+	begin func(body io.ReadCloser) io.ReadCloser
+}
+
+func (b *flightBody) Read(p []byte) (int, error) {
+	b.start()
+	return b.ReadCloser.Read(p)
+}
+
+func (b *flightBody) Close() error {
+	b.start()
+	return b.ReadCloser.Close()
+}
+
+func (b *flightBody) start() {
+	if b.begin != nil {
+		b.ReadCloser = b.begin(b.ReadCloser)
+		b.begin = nil
+	}
+}
+
+// finish ends a flight and hands its result to the requests waiting for it.
+func (g *flightGroup) finish(key string, f *flight, entry *cacheEntry, err error) {
+	g.mu.Lock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+	g.mu.Unlock()
+
+	f.entry, f.err = entry, err
+	close(f.done)
+}
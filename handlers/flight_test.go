@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchSiteCoalescesRequests(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte(`<html><body><a href="/next">` + r.URL.Path + `</a></body></html>`))
+	}))
+	defer upstream.Close()
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+	defer func(c *responseCache) { responses = c }(responses)
+	responses = nil
+
+	// fetch sends n identical requests at once, and releases the upstream once they all wait
+	fetch := func(path string, n int, fwd func(int) *forwardedRequest) []string {
+		hits.Store(0)
+		release = make(chan struct{})
+
+		bodies := make([]string, n)
+		var wg sync.WaitGroup
+		for i := range bodies {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				result, err := fetchSite(upstream.URL+path, nil, fwd(i))
+				if !assert.NoError(t, err) {
+					return
+				}
+				bodies[i] = result.body
+				if result.stream != nil {
+					b, _ := io.ReadAll(result.stream)
+					result.stream.Close()
+					bodies[i] = string(b)
+				}
+			}()
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		return bodies
+	}
+	noSession := func(int) *forwardedRequest { return nil }
+
+	for _, contentType := range []string{"text/html", "application/octet-stream"} {
+		bodies := fetch("/page?type="+contentType, 5, noSession)
+		assert.Equal(t, int32(1), hits.Load(), contentType)
+		for _, body := range bodies {
+			assert.Equal(t, bodies[0], body)
+			assert.Contains(t, body, "/page")
+		}
+	}
+
+	// the requests of different sessions are not shared
+	sessions := []*session{newSession(), newSession()}
+	fetch("/page", 2, func(i int) *forwardedRequest {
+		return &forwardedRequest{method: http.MethodGet, jar: sessions[i]}
+	})
+	assert.Equal(t, int32(2), hits.Load())
+
+	flights.mu.Lock()
+	defer flights.mu.Unlock()
+	assert.Empty(t, flights.flights)
+}
+
+func TestFlightGroupBuffersOnlyForWaitingRequests(t *testing.T) {
+	g := &flightGroup{flights: map[string]*flight{}}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/video", nil)
+	respond := func(body io.ReadCloser) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: body, Request: req}, nil
+		}
+	}
+
+	// nobody waits, the body is passed through and new requests start their own flight
+	resp, err := g.do("alone", req, respond(io.NopCloser(strings.NewReader("stream"))))
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "stream", string(body))
+	_, buffered := resp.Body.(*flightBody).ReadCloser.(*bufferingBody)
+	assert.False(t, buffered)
+	assert.Empty(t, g.flights)
+
+	// a body the response cache buffers is shared from its buffer
+	var cached []byte
+	cacheBody := &bufferingBody{
+		ReadCloser: io.NopCloser(strings.NewReader("page")),
+		limit:      maxBodySize,
+		done:       func(body []byte, ok bool) { cached = body },
+	}
+	resp, err = g.do("cached", req, respond(cacheBody))
+	assert.NoError(t, err)
+
+	shared := make(chan *http.Response)
+	go func() {
+		resp, _ := g.do("cached", req, nil)
+		shared <- resp
+	}()
+	for waiting := 0; waiting == 0; {
+		time.Sleep(time.Millisecond)
+		g.mu.Lock()
+		waiting = g.flights["cached"].waiting
+		g.mu.Unlock()
+	}
+
+	io.ReadAll(resp.Body)
+	assert.Same(t, cacheBody, resp.Body.(*flightBody).ReadCloser)
+	assert.Equal(t, "page", string(cached))
+	body, _ = io.ReadAll((<-shared).Body)
+	assert.Equal(t, "page", string(body))
+
+	// a waiting request gives up when it is cancelled
+	release := make(chan struct{})
+	defer close(release)
+	go g.do("slow", req, func() (*http.Response, error) {
+		<-release
+		return nil, io.ErrUnexpectedEOF
+	})
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = g.do("slow", req.WithContext(ctx), nil)
+	assert.ErrorIs(t, err, context.Canceled)
+}
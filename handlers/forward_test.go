@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxySiteForwardsMethods(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Method + " " + r.Header.Get("Content-Type") + "\n"))
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(`
+- domain: 127.0.0.1
+  paths:
+    - /readonly
+  methods: [GET]
+`), 0o644)
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+	defer func(size int) { MaxRequestBodySize = size }(MaxRequestBodySize)
+
+	proxy := ProxySite(filepath.Join(dir, "rules.yaml"))
+	app := fiber.New()
+	app.Get("/*", proxy)
+	for _, method := range []string{fiber.MethodPost, fiber.MethodPut, fiber.MethodOptions} {
+		app.Add(method, "/*", proxy)
+	}
+
+	// a form post
+	req := httptest.NewRequest(http.MethodPost, "/"+upstream.URL+"/search", strings.NewReader("q=ladder"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "POST application/x-www-form-urlencoded\nq=ladder", string(body))
+
+	// a multipart upload keeps its boundary
+	var upload bytes.Buffer
+	mw := multipart.NewWriter(&upload)
+	fw, _ := mw.CreateFormFile("file", "notes.txt")
+	fw.Write([]byte("hello"))
+	mw.Close()
+
+	req = httptest.NewRequest(http.MethodPut, "/"+upstream.URL+"/upload", bytes.NewReader(upload.Bytes()))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err = app.Test(req)
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "PUT "+mw.FormDataContentType()+"\n"+upload.String(), string(body))
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodOptions, "/"+upstream.URL+"/search", nil))
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "OPTIONS \n", string(body))
+
+	// the rule only allows GET, and so HEAD
+	resp, err = app.Test(httptest.NewRequest(http.MethodPost, "/"+upstream.URL+"/readonly", strings.NewReader("x")))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodHead, "/"+upstream.URL+"/readonly", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// bodies over MAX_REQUEST_BODY_SIZE are refused
+	MaxRequestBodySize = 4
+	resp, err = app.Test(httptest.NewRequest(http.MethodPost, "/"+upstream.URL+"/search", strings.NewReader("q=ladder")))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+}
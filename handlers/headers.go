@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"ladder/pkg/ruleset"
+)
+
+// allowedResponseHeaders are the upstream response headers passed to the client by default,
+// RESPONSE_HEADERS_ALLOW replaces them.
+var allowedResponseHeaders = headerSet(
+	"Cache-Control", "Expires", "Pragma", "Age", "ETag", "Last-Modified", "Vary",
+	"Content-Disposition", "Content-Language", "Content-Security-Policy",
+	"Link", "Retry-After", "Allow", "WWW-Authenticate",
+)
+
+// deniedResponseHeaders are the upstream response headers that are not passed to the client,
+// even if "*" allows all headers, unless a rule allows them by name. They would apply to the
+// proxy origin instead of the upstream one. RESPONSE_HEADERS_DENY replaces them.
+var deniedResponseHeaders = headerSet(
+	"Set-Cookie", "Set-Cookie2", "Strict-Transport-Security", "Alt-Svc", "Clear-Site-Data",
+	"Public-Key-Pins", "Public-Key-Pins-Report-Only", "Expect-CT", "Report-To", "NEL",
+)
+
+// managedResponseHeaders are never copied from the upstream: hop-by-hop headers, and headers
+// the proxy sets itself.
+var managedResponseHeaders = headerSet(
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"TE", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length", "Content-Encoding", "Content-Type", "Location",
+)
+
+// headerSet returns a set of canonical header names.
+func headerSet(names ...string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			set[headerKey(name)] = true
+		}
+	}
+
+	return set
+}
+
+func headerKey(name string) string {
+	if name == "*" {
+		return name
+	}
+
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+// copyResponseHeaders copies the upstream response headers that the policy of the rule and the
+// default policy allow to dst. Hop-by-hop headers, including those listed in Connection, and
+// the headers the proxy sets itself are never copied.
+func copyResponseHeaders(dst, src http.Header, policy ruleset.HeaderPolicy) {
+	allow, deny := headerSet(policy.Allow...), headerSet(policy.Deny...)
+
+	hopByHop := map[string]bool{}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				hopByHop[headerKey(name)] = true
+			}
+		}
+	}
+
+	for name, values := range src {
+		if managedResponseHeaders[name] || hopByHop[name] || !headerAllowed(name, allow, deny) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// headerAllowed decides whether a response header is passed to the client. The deny list of
+// the rule comes first, then the headers the rule allows by name, the default deny list,
+// "*" in the allow list of the rule and finally the default allow list.
+func headerAllowed(name string, allow, deny map[string]bool) bool {
+	switch {
+	case deny[name] || deny["*"]:
+		return false
+	case allow[name]:
+		return true
+	case deniedResponseHeaders[name]:
+		return false
+	default:
+		return allow["*"] || allowedResponseHeaders[name] || allowedResponseHeaders["*"]
+	}
+}
+
+// applyHeaderRules runs the requestHeaders or responseHeaders operations of a rule on h, in order.
+// For responseHeaders, info is the upstream response their conditions are evaluated against.
+func applyHeaderRules(h http.Header, headerRules []ruleset.HeaderRule, info *ruleset.ResponseInfo) {
+	for _, hr := range headerRules {
+		if info != nil && !hr.When.Match(*info) {
+			continue
+		}
+
+		switch {
+		case hr.Op == ruleset.HeaderDelete || hr.Value == "none":
+			h.Del(hr.Name)
+		case hr.Op == ruleset.HeaderAppend:
+			h.Add(hr.Name, hr.Value)
+		default:
+			h.Set(hr.Name, hr.Value)
+		}
+	}
+}
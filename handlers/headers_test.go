@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyHeaderRules(t *testing.T) {
+	rule := testRule(t, `
+domain: example.com
+requestHeaders:
+  - name: Accept-Language
+    value: de-CH
+  - name: cache-control
+    value: no-cache
+  - name: Cache-Control
+    value: no-store
+    op: append
+  - name: X-Tracking
+    op: delete
+  - name: Referer
+    value: none
+`)
+
+	h := http.Header{}
+	h.Set("Accept-Language", "en-US")
+	h.Set("X-Tracking", "1")
+	h.Set("Referer", "https://example.com/")
+
+	applyHeaderRules(h, rule.RequestHeaders, nil)
+
+	assert.Equal(t, "de-CH", h.Get("Accept-Language"))
+	assert.Equal(t, []string{"no-cache", "no-store"}, h.Values("Cache-Control"))
+	assert.NotContains(t, h, "X-Tracking")
+	assert.NotContains(t, h, "Referer")
+}
+
+func TestCopyResponseHeaders(t *testing.T) {
+	upstream := http.Header{}
+	upstream.Set("Cache-Control", "max-age=60")
+	upstream.Set("ETag", `"abc"`)
+	upstream.Set("Content-Language", "de")
+	upstream.Set("Set-Cookie", "session=1")
+	upstream.Set("Strict-Transport-Security", "max-age=31536000")
+	upstream.Set("Transfer-Encoding", "chunked")
+	upstream.Set("Connection", "X-Hop")
+	upstream.Set("X-Hop", "1")
+	upstream.Set("X-Custom", "1")
+
+	h := http.Header{}
+	copyResponseHeaders(h, upstream, testRule(t, "domain: example.com").HeaderPolicy)
+	assert.Equal(t, http.Header{
+		"Cache-Control":    {"max-age=60"},
+		"Etag":             {`"abc"`},
+		"Content-Language": {"de"},
+	}, h)
+
+	// the rule overrides the defaults
+	h = http.Header{}
+	copyResponseHeaders(h, upstream, testRule(t, `
+domain: example.com
+headerPolicy:
+  allow: [x-custom, Set-Cookie]
+  deny: [Cache-Control]
+`).HeaderPolicy)
+	assert.Equal(t, http.Header{
+		"Etag":             {`"abc"`},
+		"Content-Language": {"de"},
+		"Set-Cookie":       {"session=1"},
+		"X-Custom":         {"1"},
+	}, h)
+
+	// * allows everything but the default deny list and hop-by-hop headers
+	h = http.Header{}
+	copyResponseHeaders(h, upstream, testRule(t, "{domain: example.com, headerPolicy: {allow: ['*']}}").HeaderPolicy)
+	assert.ElementsMatch(t, []string{"Cache-Control", "Etag", "Content-Language", "X-Custom"}, keys(h))
+}
+
+func TestProxySitePropagatesStatus(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Set-Cookie", "session=1")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<p>not found</p>"))
+	}))
+	defer upstream.Close()
+
+	app := fiber.New()
+	app.Get("/*", ProxySite(""))
+
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/missing", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, `W/"v1"`, resp.Header.Get("ETag"))
+	assert.Empty(t, resp.Header.Values("Set-Cookie"))
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "<p>not found</p>", string(body))
+}
+
+func keys(h http.Header) []string {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// modifyResponse is the response modification stage of the proxy pipeline.
+// It applies the regex rules and injections of a rule whose conditions match the
+// response. Unless a regex rule restricts the content type itself, regex rules and
+// injections only apply to HTML documents, so images, JSON, scripts and binaries
+// are left untouched.
+// raw is the unmodified upstream body, used to sniff the content type when
+// the upstream did not send one.
+func modifyResponse(body string, raw []byte, resp *http.Response, rule ruleset.Rule) (string, error) {
+	if len(rule.RegexRules) == 0 && len(rule.Injections) == 0 {
+		return body, nil
+	}
+
+	info := responseInfo(resp, raw)
+	if !rule.When.Match(info) {
+		return body, nil
+	}
+
+	body, err := applyRules(body, rule, info)
+	if err != nil {
+		return "", fmt.Errorf("failed to apply rules to %s: %w", resp.Request.URL, err)
+	}
+
+	return body, nil
+}
+
+// responseInfo describes an upstream response for evaluating the conditions of a rule.
+// The content type is sniffed from the body if the upstream did not send one.
+func responseInfo(resp *http.Response, raw []byte) ruleset.ResponseInfo {
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(raw)
+	}
+
+	return ruleset.ResponseInfo{
+		StatusCode:  resp.StatusCode,
+		Header:      resp.Header,
+		ContentType: contentType,
+		Size:        len(raw),
+	}
+}
+
+// isHtml reports whether a content type is an HTML document.
+func isHtml(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/html" || mediaType == "application/xhtml+xml"
+}
+
+// isCss reports whether a content type is a stylesheet.
+func isCss(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "text/css"
+}
+
+// applyRules applies the regex rules and then the injections of a rule whose conditions
+// match the response. The document is parsed once for all injections.
+func applyRules(body string, rule ruleset.Rule, info ruleset.ResponseInfo) (string, error) {
+	html := isHtml(info.ContentType)
+
+	for _, regexRule := range rule.RegexRules {
+		if !html && !regexRule.When.HasContentType() {
+			continue
+		}
+		if !regexRule.When.Match(info) {
+			continue
+		}
+
+		body = regexRule.Regexp().ReplaceAllString(body, regexRule.Replace)
+	}
+
+	if !html {
+		return body, nil
+	}
+
+	var injections []ruleset.Injection
+	for _, injection := range rule.Injections {
+		if injection.When.Match(info) {
+			injections = append(injections, injection)
+		}
+	}
+
+	if len(injections) == 0 {
+		return body, nil
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse document: %w", err)
+	}
+
+	for _, injection := range injections {
+		applyInjection(doc, injection)
+	}
+
+	body, err = doc.Html()
+	if err != nil {
+		return "", fmt.Errorf("failed to render document: %w", err)
+	}
+
+	return body, nil
+}
+
+// applyInjection runs the operations of an injection on the matching elements of doc.
+// Every operation selects the elements again, so it sees the result of the previous one.
+func applyInjection(doc *goquery.Document, injection ruleset.Injection) {
+	find := func() *goquery.Selection {
+		sel := doc.FindMatcher(injection.Selector())
+		if injection.Limit > 0 && sel.Length() > injection.Limit {
+			sel = sel.Slice(0, injection.Limit)
+		}
+		return sel
+	}
+
+	if injection.Replace != "" {
+		find().ReplaceWithHtml(injection.Replace)
+	}
+	if injection.SetText != "" {
+		find().SetText(injection.SetText)
+	}
+	if len(injection.SetAttr) > 0 {
+		sel := find()
+		for name, value := range injection.SetAttr {
+			sel.SetAttr(name, value)
+		}
+	}
+	if len(injection.RemoveAttr) > 0 {
+		sel := find()
+		for _, name := range injection.RemoveAttr {
+			sel.RemoveAttr(name)
+		}
+	}
+	if injection.AddClass != "" {
+		find().AddClass(strings.Fields(injection.AddClass)...)
+	}
+	if injection.RemoveClass != "" {
+		find().RemoveClass(strings.Fields(injection.RemoveClass)...)
+	}
+	if injection.Prepend != "" {
+		find().PrependHtml(injection.Prepend)
+	}
+	if injection.Append != "" {
+		find().AppendHtml(injection.Append)
+	}
+	if injection.Before != "" {
+		find().BeforeHtml(injection.Before)
+	}
+	if injection.After != "" {
+		find().AfterHtml(injection.After)
+	}
+	if injection.Wrap != "" {
+		find().WrapHtml(injection.Wrap)
+	}
+	if injection.Unwrap {
+		find().Each(func(_ int, s *goquery.Selection) {
+			s.ReplaceWithSelection(s.Contents())
+		})
+	}
+	if injection.Remove {
+		find().Remove()
+	}
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func testRule(t *testing.T, y string) ruleset.Rule {
+	t.Helper()
+
+	var rule ruleset.Rule
+	if err := yaml.Unmarshal([]byte(y), &rule); err != nil {
+		t.Fatalf("failed to parse rule: %s", err)
+	}
+
+	return rule
+}
+
+func testResponse(contentType string) *http.Response {
+	u, _ := url.Parse("https://example.com/")
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Request: &http.Request{URL: u}}
+	if contentType != "" {
+		resp.Header.Set("Content-Type", contentType)
+	}
+
+	return resp
+}
+
+func TestModifyResponse(t *testing.T) {
+	rule := testRule(t, `
+domain: example.com
+regexRules:
+  - match: foo
+    replace: bar
+injections:
+  - position: body
+    append: <p id="injected"></p>
+`)
+
+	html := `<html><head></head><body>foo</body></html>`
+
+	body, err := modifyResponse(html, []byte(html), testResponse("text/html; charset=utf-8"), rule)
+	assert.NoError(t, err)
+	assert.Contains(t, body, "bar")
+	assert.Contains(t, body, `<p id="injected"></p>`)
+
+	// sniffed when the upstream sends no content type
+	body, err = modifyResponse(html, []byte(html), testResponse(""), rule)
+	assert.NoError(t, err)
+	assert.Contains(t, body, `<p id="injected"></p>`)
+
+	for _, contentType := range []string{"application/json", "image/png", "text/javascript", "application/octet-stream"} {
+		body, err = modifyResponse("foo", []byte("foo"), testResponse(contentType), rule)
+		assert.NoError(t, err)
+		assert.Equal(t, "foo", body, contentType)
+	}
+}
+
+func TestApplyInjectionOperations(t *testing.T) {
+	rule := testRule(t, `
+domain: example.com
+injections:
+  - position: .ad
+    remove: true
+  - position: .paywall
+    removeAttr: [style]
+    removeClass: paywall locked
+    addClass: free
+  - position: img
+    limit: 1
+    setAttr:
+      loading: eager
+  - position: h1
+    setText: Title & more
+    before: <nav id="before"></nav>
+    after: <nav id="after"></nav>
+  - position: .wrapper
+    unwrap: true
+  - position: p.content
+    wrap: <section id="wrapped"></section>
+`)
+
+	html := `<html><head></head><body>
+<div class="ad">ad</div><div class="ad">ad</div>
+<h1>Old</h1>
+<div class="paywall locked" style="filter: blur(4px)">text</div>
+<img src="a.png"><img src="b.png">
+<div class="wrapper"><p class="content">inner</p></div>
+</body></html>`
+
+	body, err := applyRules(html, rule, responseInfo(testResponse("text/html"), []byte(html)))
+	assert.NoError(t, err)
+
+	assert.NotContains(t, body, `class="ad"`)
+	assert.Contains(t, body, `<div class="free">text</div>`)
+	assert.Contains(t, body, `<img src="a.png" loading="eager"/><img src="b.png"/>`)
+	assert.Contains(t, body, `<nav id="before"></nav><h1>Title &amp; more</h1><nav id="after"></nav>`)
+	assert.NotContains(t, body, "wrapper")
+	assert.Contains(t, body, `<section id="wrapped"><p class="content">inner</p></section>`)
+}
+
+func TestModifyResponseConditions(t *testing.T) {
+	rule := testRule(t, `
+domain: example.com
+regexRules:
+  - match: '"paywall":true'
+    replace: '"paywall":false'
+    when:
+      contentType: application/json
+  - match: foo
+    replace: bar
+injections:
+  - position: .error
+    remove: true
+    when:
+      status: 4xx
+`)
+
+	json := `{"paywall":true,"foo":1}`
+	body, err := modifyResponse(json, []byte(json), testResponse("application/json"), rule)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"paywall":false,"foo":1}`, body)
+
+	html := `<html><head></head><body><p class="error">foo</p></body></html>`
+	body, err = modifyResponse(html, []byte(html), testResponse("text/html"), rule)
+	assert.NoError(t, err)
+	assert.Contains(t, body, `<p class="error">bar</p>`)
+
+	resp := testResponse("text/html")
+	resp.StatusCode = http.StatusNotFound
+	body, err = modifyResponse(html, []byte(html), resp, rule)
+	assert.NoError(t, err)
+	assert.NotContains(t, body, "error")
+
+	// the rule's own conditions restrict all of its modifications
+	rule.When = testRule(t, "when: {status: 5xx}").When
+	body, err = modifyResponse(html, []byte(html), resp, rule)
+	assert.NoError(t, err)
+	assert.Equal(t, html, body)
+}
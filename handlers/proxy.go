@@ -9,22 +9,29 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"ladder/pkg/outbound"
 	"ladder/pkg/ruleset"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/gofiber/fiber/v2"
 )
 
 // FlareSolverrRequest represents the request structure for FlareSolverr API
 type FlareSolverrRequest struct {
-	Cmd        string `json:"cmd"`
-	URL        string `json:"url"`
-	MaxTimeout int    `json:"maxTimeout"`
+	Cmd        string             `json:"cmd"`
+	URL        string             `json:"url"`
+	MaxTimeout int                `json:"maxTimeout"`
+	Proxy      *FlareSolverrProxy `json:"proxy,omitempty"`
+}
+
+// FlareSolverrProxy is the proxy FlareSolverr uses to load the page
+type FlareSolverrProxy struct {
+	URL      string `json:"url"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 // FlareSolverrResponse represents the response structure from FlareSolverr API
@@ -52,13 +59,17 @@ type FlareSolverrResponse struct {
 }
 
 var (
-	UserAgent        = getenv("USER_AGENT", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
-	ForwardedFor     = getenv("X_FORWARDED_FOR", "66.249.66.1")
-	flareSolverrHost = os.Getenv("FLARESOLVERR_HOST")
-	rulesSet         = ruleset.NewRulesetFromEnv()
-	allowedDomains   = []string{}
-	defaultTimeout   = 15 // in seconds
-	basePath         = normalizeBasePath(os.Getenv("BASE_PATH"))
+	UserAgent          = getenv("USER_AGENT", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)")
+	ForwardedFor       = getenv("X_FORWARDED_FOR", "66.249.66.1")
+	flareSolverrHost   = os.Getenv("FLARESOLVERR_HOST")
+	rules              = ruleset.NewReloaderFromEnv()
+	allowedDomains     = []string{}
+	allowRuleDomains   = os.Getenv("ALLOWED_DOMAINS_RULESET") == "true"
+	maxBodySize        = int64(10 << 20)
+	MaxRequestBodySize = 10 << 20 // largest request body forwarded upstream, in bytes
+	basePath           = normalizeBasePath(os.Getenv("BASE_PATH"))
+	clientRuntime      = ruleset.RuntimeOff
+	redirectPolicy     = ruleset.RedirectFollow
 )
 
 func normalizeBasePath(p string) string {
@@ -72,12 +83,34 @@ func normalizeBasePath(p string) string {
 }
 
 func init() {
-	allowedDomains = strings.Split(os.Getenv("ALLOWED_DOMAINS"), ",")
-	if os.Getenv("ALLOWED_DOMAINS_RULESET") == "true" {
-		allowedDomains = append(allowedDomains, rulesSet.Domains()...)
+	for _, domain := range strings.Split(os.Getenv("ALLOWED_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			allowedDomains = append(allowedDomains, domain)
+		}
+	}
+	if sizeStr := os.Getenv("MAX_BODY_SIZE"); sizeStr != "" {
+		if size, err := strconv.ParseInt(sizeStr, 10, 64); err == nil && size > 0 {
+			maxBodySize = size
+		}
+	}
+	if sizeStr := os.Getenv("MAX_REQUEST_BODY_SIZE"); sizeStr != "" {
+		if size, err := strconv.Atoi(sizeStr); err == nil && size > 0 {
+			MaxRequestBodySize = size
+		}
+	}
+	if allow, ok := os.LookupEnv("RESPONSE_HEADERS_ALLOW"); ok {
+		allowedResponseHeaders = headerSet(strings.Split(allow, ",")...)
+	}
+	if deny, ok := os.LookupEnv("RESPONSE_HEADERS_DENY"); ok {
+		deniedResponseHeaders = headerSet(strings.Split(deny, ",")...)
+	}
+	switch p := os.Getenv("REDIRECT_POLICY"); p {
+	case ruleset.RedirectFollow, ruleset.RedirectPass:
+		redirectPolicy = p
 	}
-	if timeoutStr := os.Getenv("HTTP_TIMEOUT"); timeoutStr != "" {
-		defaultTimeout, _ = strconv.Atoi(timeoutStr)
+	switch r := os.Getenv("CLIENT_RUNTIME"); r {
+	case ruleset.RuntimeOff, ruleset.RuntimeShim, ruleset.RuntimeServiceWorker:
+		clientRuntime = r
 	}
 }
 
@@ -133,8 +166,12 @@ func extractUrl(c *fiber.Ctx) (string, error) {
 	return urlQuery.String(), nil
 }
 
-// getFlareSolverrCookies retrieves cookies from FlareSolverr for the given URL
-func getFlareSolverrCookies(targetURL string) (string, error) {
+// flareSolverrTimeout is the time FlareSolverr may spend on a challenge.
+const flareSolverrTimeout = 60 * time.Second
+
+// getFlareSolverrCookies retrieves cookies from FlareSolverr for the given URL,
+// loaded through the outbound proxy setting of its rule.
+func getFlareSolverrCookies(targetURL string, proxy string) (string, error) {
 	if flareSolverrHost == "" {
 		return "", fmt.Errorf("FLARESOLVERR_HOST environment variable not set")
 	}
@@ -142,7 +179,8 @@ func getFlareSolverrCookies(targetURL string) (string, error) {
 	reqBody := FlareSolverrRequest{
 		Cmd:        "request.get",
 		URL:        targetURL,
-		MaxTimeout: 60000,
+		MaxTimeout: int(flareSolverrTimeout.Milliseconds()),
+		Proxy:      flareSolverrProxy(proxy),
 	}
 
 	jsonData, err := json.Marshal(reqBody)
@@ -150,7 +188,14 @@ func getFlareSolverrCookies(targetURL string) (string, error) {
 		return "", err
 	}
 
-	resp, err := http.Post(flareSolverrHost+"/v1", "application/json", bytes.NewBuffer(jsonData))
+	transport, err := transportFor(defaultTransport, "")
+	if err != nil {
+		return "", err
+	}
+
+	// FlareSolverr gets some time on top of the time it may spend solving the challenge
+	client := &http.Client{Transport: transport, Timeout: flareSolverrTimeout + 10*time.Second}
+	resp, err := client.Post(flareSolverrHost+"/v1", "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", err
 	}
@@ -174,13 +219,35 @@ func getFlareSolverrCookies(targetURL string) (string, error) {
 	return strings.Join(cookies, "; "), nil
 }
 
+// flareSolverrProxy returns the FlareSolverr proxy for an outbound proxy setting,
+// nil if the browser of FlareSolverr connects directly.
+func flareSolverrProxy(setting string) *FlareSolverrProxy {
+	u, err := outbound.Parse(setting)
+	if err != nil || u == nil {
+		return nil
+	}
+
+	p := &FlareSolverrProxy{}
+	if u.User != nil {
+		p.Username = u.User.Username()
+		p.Password, _ = u.User.Password()
+	}
+	// the browser of FlareSolverr always resolves hosts through a SOCKS proxy
+	if u.Scheme == "socks5h" {
+		u.Scheme = "socks5"
+	}
+	p.URL = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String()
+
+	return p
+}
+
 func ProxySite(rulesetPath string) fiber.Handler {
 	if rulesetPath != "" {
-		rs, err := ruleset.NewRuleset(rulesetPath)
+		rs, err := ruleset.NewReloader(rulesetPath)
 		if err != nil {
 			panic(err)
 		}
-		rulesSet = rs
+		rules = rs
 	}
 
 	return func(c *fiber.Ctx) error {
@@ -190,19 +257,62 @@ func ProxySite(rulesetPath string) fiber.Handler {
 			log.Println("ERROR In URL extraction:", err)
 		}
 
+		fwd := &forwardedRequest{
+			method:      c.Method(),
+			body:        c.Body(),
+			contentType: c.Get("Content-Type"),
+			accept:      c.Get("Accept-Encoding"),
+		}
+		sess := clientSession(c)
+		if sess != nil {
+			fwd.jar = sess
+		}
+
 		queries := c.Queries()
-		body, _, resp, err := fetchSite(url, queries)
+		result, err := fetchSite(url, queries, fwd)
+		saveSession(c, sess)
 		if err != nil {
 			log.Println("ERROR:", err)
-			c.SendStatus(fiber.StatusInternalServerError)
+			c.SendStatus(errorStatus(err))
 			return c.SendString(err.Error())
 		}
 
-		c.Cookie(&fiber.Cookie{})
-		c.Set("Content-Type", resp.Header.Get("Content-Type"))
-		c.Set("Content-Security-Policy", resp.Header.Get("Content-Security-Policy"))
+		header := http.Header{}
+		copyResponseHeaders(header, result.resp.Header, result.rule.HeaderPolicy)
+		header.Set("Content-Type", result.resp.Header.Get("Content-Type"))
+		// a streamed body keeps the encoding of the upstream if the client accepts it
+		if encoding := result.resp.Header.Get("Content-Encoding"); encoding != "" {
+			header.Set("Content-Encoding", encoding)
+			header.Add("Vary", "Accept-Encoding")
+		}
+
+		// the rewritten body is no longer byte for byte the one the ETag of the upstream names
+		if etag := header.Get("ETag"); etag != "" && result.stream == nil && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
 
-		return c.SendString(body)
+		// a redirect that was not followed takes the client to the proxied Location
+		if next := redirectLocation(result.resp); next != nil {
+			header.Set("Location", rewriteUrl(next.String(), next, result.matcher))
+		}
+		applyHeaderRules(header, result.rule.ResponseHeaders, &result.info)
+
+		c.Status(result.resp.StatusCode)
+		for name, values := range header {
+			for i, value := range values {
+				if i == 0 {
+					c.Set(name, value)
+				} else {
+					c.Response().Header.Add(name, value)
+				}
+			}
+		}
+
+		if result.stream != nil {
+			return c.SendStream(result.stream, int(result.resp.ContentLength))
+		}
+
+		return c.SendString(result.body)
 	}
 }
 
@@ -213,13 +323,11 @@ func modifyURL(uri string, rule ruleset.Rule) (string, error) {
 	}
 
 	for _, urlMod := range rule.URLMods.Domain {
-		re := regexp.MustCompile(urlMod.Match)
-		newUrl.Host = re.ReplaceAllString(newUrl.Host, urlMod.Replace)
+		newUrl.Host = urlMod.Regexp().ReplaceAllString(newUrl.Host, urlMod.Replace)
 	}
 
 	for _, urlMod := range rule.URLMods.Path {
-		re := regexp.MustCompile(urlMod.Match)
-		newUrl.Path = re.ReplaceAllString(newUrl.Path, urlMod.Replace)
+		newUrl.Path = urlMod.Regexp().ReplaceAllString(newUrl.Path, urlMod.Replace)
 	}
 
 	v := newUrl.Query()
@@ -242,7 +350,40 @@ func modifyURL(uri string, rule ruleset.Rule) (string, error) {
 	return newUrl.String(), nil
 }
 
-func fetchSite(urlpath string, queries map[string]string) (string, *http.Request, *http.Response, error) {
+// fetchResult is an upstream response that went through the proxy pipeline.
+// Bodies that were rewritten are in body. Bodies that need no rewriting are not read
+// and must be sent from stream, which the receiver has to close.
+type fetchResult struct {
+	body   string
+	stream io.ReadCloser
+	req    *http.Request
+	resp   *http.Response
+	// rule is the merged rule that was applied.
+	rule ruleset.Rule
+	// matcher is the ruleset the request used.
+	matcher *ruleset.Matcher
+	// info describes the upstream response the conditions of the rule were evaluated against.
+	info ruleset.ResponseInfo
+	// matchedBy describes which matchers selected the applied rules, see ruleset.Selection.
+	matchedBy []string
+	// redirects are the redirects that were followed to get resp.
+	redirects []redirectHop
+}
+
+// forwardedRequest is the method and body of a client request that fetchSite forwards upstream.
+type forwardedRequest struct {
+	method      string
+	body        []byte
+	contentType string // including the boundary of multipart bodies
+	// accept is the Accept-Encoding of the client, the encodings a streamed body may keep.
+	accept string
+	// jar keeps the upstream cookies of the client session, nil if there is none.
+	jar http.CookieJar
+}
+
+// fetchSite fetches a URL through the proxy pipeline. fwd is the client request to forward,
+// nil fetches the URL with GET.
+func fetchSite(urlpath string, queries map[string]string, fwd *forwardedRequest) (*fetchResult, error) {
 	urlQuery := "?"
 	if len(queries) > 0 {
 		for k, v := range queries {
@@ -254,11 +395,20 @@ func fetchSite(urlpath string, queries map[string]string) (string, *http.Request
 
 	u, err := url.Parse(urlpath)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
 	}
 
-	if len(allowedDomains) > 0 && !StringInSlice(u.Host, allowedDomains) {
-		return "", nil, nil, fmt.Errorf("domain not allowed. %s not in %s", u.Host, allowedDomains)
+	// the requested URL including the query, used to select the rule
+	fullUrl, err := url.Parse(u.String() + urlQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	// the whole request, including its redirects, uses the ruleset current when it started
+	matcher := rules.Current()
+
+	if !domainAllowed(matcher, fullUrl) {
+		return nil, fmt.Errorf("domain not allowed. %s not in %s", u.Host, allowedDomains)
 	}
 
 	if os.Getenv("LOG_URLS") == "true" {
@@ -266,17 +416,164 @@ func fetchSite(urlpath string, queries map[string]string) (string, *http.Request
 	}
 
 	// Modify the URI according to ruleset
-	rule := fetchRule(u.Host, u.Path)
+	sel := fetchRule(matcher, fullUrl)
+	rule := sel.Rule
+	if os.Getenv("LOG_URLS") == "true" && len(sel.MatchedBy) > 0 {
+		log.Printf("rule for %s selected by: %s", fullUrl, strings.Join(sel.MatchedBy, ", "))
+	}
+
 	url, err := modifyURL(u.String()+urlQuery, rule)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
+	}
+
+	if fwd == nil {
+		fwd = &forwardedRequest{method: http.MethodGet}
+	}
+	if len(fwd.body) > MaxRequestBodySize {
+		return nil, errRequestBodyTooLarge
+	}
+
+	var (
+		req     *http.Request
+		resp    *http.Response
+		hops    []redirectHop
+		timeout *upstreamTimeout
+	)
+
+	for {
+		if !methodAllowed(fwd.method, rule) {
+			return nil, fmt.Errorf("%w: %s %s", errMethodNotAllowed, fwd.method, u.Host)
+		}
+
+		req, err = newUpstreamRequest(fwd, url, u, rule)
+		if err != nil {
+			return nil, err
+		}
+		req, timeout = withTimeout(req, rule)
+
+		resp, err = sendUpstream(req, rule, fwd)
+		if err != nil {
+			timeout.done()
+			return nil, timeout.wrap(err)
+		}
+
+		// redirects that are not followed, also those to domains that are not allowed,
+		// are passed to the client
+		next := redirectLocation(resp)
+		if next == nil || !followRedirects(rule) || !domainAllowed(matcher, next) {
+			break
+		}
+		resp.Body.Close()
+		timeout.done()
+
+		hops = append(hops, redirectHop{URL: url, StatusCode: resp.StatusCode, Location: next.String()})
+		if len(hops) > maxRedirects {
+			return nil, fmt.Errorf("%w: %s", errTooManyRedirects, u)
+		}
+
+		fwd = fwd.redirected(resp.StatusCode)
+		u = next
+		sel = fetchRule(matcher, next)
+		rule = sel.Rule
+		// every hop is modified by the rule of its own URL
+		if url, err = modifyURL(next.String(), rule); err != nil {
+			return nil, err
+		}
+		if os.Getenv("LOG_URLS") == "true" {
+			log.Printf("redirected to %s", url)
+		}
 	}
 
-	// Fetch the site
-	client := &http.Client{
-		Timeout: time.Second * time.Duration(defaultTimeout),
+	if rule.Headers.CSP != "" {
+		// log.Println(rule.Headers.CSP)
+		resp.Header.Set("Content-Security-Policy", rule.Headers.CSP)
+	} else {
+		resp.Header.Del("Content-Security-Policy")
 	}
-	req, _ := http.NewRequest("GET", url, nil)
+
+	result := &fetchResult{req: req, resp: resp, rule: rule, matcher: matcher, matchedBy: sel.MatchedBy, redirects: hops}
+
+	// the type of a body the upstream sent none for is sniffed from its decoded content
+	if resp.Header.Get("Content-Type") == "" {
+		if err := decodeContentEncoding(resp); err != nil {
+			timeout.done()
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	// bodies that are not rewritten are streamed to the client, the caller closes them. They
+	// are passed through with their encoding and length if the client accepts the encoding.
+	contentType := sniffContentType(resp)
+	if req.Method == http.MethodHead || !needsRewrite(contentType, rule) {
+		if !acceptsEncoding(fwd.accept, resp.Header.Get("Content-Encoding")) {
+			if err := decodeContentEncoding(resp); err != nil {
+				timeout.done()
+				resp.Body.Close()
+				return nil, err
+			}
+		}
+		timeout.stream()
+		result.stream = &streamedBody{ReadCloser: resp.Body, timeout: timeout}
+		result.info = ruleset.ResponseInfo{
+			StatusCode:  resp.StatusCode,
+			Header:      resp.Header,
+			ContentType: contentType,
+			Size:        int(resp.ContentLength),
+		}
+
+		return result, nil
+	}
+
+	defer timeout.done()
+	defer resp.Body.Close()
+
+	if err := decodeContentEncoding(resp); err != nil {
+		return nil, err
+	}
+	bodyB, err := readBody(resp)
+	if err != nil {
+		return nil, timeout.wrap(err)
+	}
+	bodyB = decodeCharset(bodyB, resp, contentType)
+
+	// log.Print("rule", rule) TODO: Add a debug mode to print the rule
+	var body string
+	if cacheable(req, rule, fwd) {
+		body, err = responses.rewrite(bodyB, u, resp, rule, matcher)
+	} else {
+		body, err = rewriteResponse(bodyB, u, resp, rule, matcher)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hops) > 0 && isHtml(contentType) {
+		body = withBase(body, u)
+	}
+
+	result.body = body
+	result.info = responseInfo(resp, bodyB)
+
+	return result, nil
+}
+
+// newUpstreamRequest builds the request for an upstream URL, with the headers of the rule.
+// page is the URL of the requested page, sent as the default Referer.
+func newUpstreamRequest(fwd *forwardedRequest, url string, page *url.URL, rule ruleset.Rule) (*http.Request, error) {
+	var reqBody io.Reader
+	if len(fwd.body) > 0 {
+		reqBody = bytes.NewReader(fwd.body)
+	}
+	req, err := http.NewRequest(fwd.method, url, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if fwd.contentType != "" {
+		req.Header.Set("Content-Type", fwd.contentType)
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
 
 	if rule.Headers.UserAgent != "" {
 		req.Header.Set("User-Agent", rule.Headers.UserAgent)
@@ -297,77 +594,114 @@ func fetchSite(urlpath string, queries map[string]string) (string, *http.Request
 			req.Header.Set("Referer", rule.Headers.Referer)
 		}
 	} else {
-		req.Header.Set("Referer", u.String())
+		req.Header.Set("Referer", page.String())
 	}
 
-	// Handle FlareSolverr integration
-	cookieValue := rule.Headers.Cookie
-	debug := os.Getenv("LOG_URLS") == "true"
+	if rule.Headers.Cookie != "" {
+		req.Header.Set("Cookie", rule.Headers.Cookie)
+	}
 
-	if rule.UseFlareSolverr && flareSolverrHost != "" {
-		if fsCookies, err := getFlareSolverrCookies(url); err == nil {
-			if cookieValue != "" {
-				cookieValue = cookieValue + "; " + fsCookies
-			} else {
-				cookieValue = fsCookies
-			}
-			if debug {
-				log.Printf("Using FlareSolverr cookies for %s", url)
-			}
-		} else if debug {
-			log.Printf("FlareSolverr error for %s: %v", url, err)
+	applyHeaderRules(req.Header, rule.RequestHeaders, nil)
+
+	return req, nil
+}
+
+// sendUpstream sends an upstream request of a rule. The body of the response keeps its
+// Content-Encoding, fetchSite decodes it if needed.
+// Requests that can be cached are answered from the response cache while it holds a fresh
+// response, and revalidated with the origin once it is stale. Identical requests in flight
+// at the same time share one upstream request.
+func sendUpstream(req *http.Request, rule ruleset.Rule, fwd *forwardedRequest) (*http.Response, error) {
+	var (
+		key   string
+		entry *cacheEntry
+	)
+	if cacheable(req, rule, fwd) {
+		key = upstreamKey(req)
+		entry = responses.get(key)
+		if entry.fresh(rule) {
+			return entry.cachedResponse(req), nil
 		}
 	}
 
-	if cookieValue != "" {
-		req.Header.Set("Cookie", cookieValue)
+	if !coalescable(req, fwd) {
+		return fetchUpstream(req, rule, fwd, key, entry)
 	}
 
-	resp, err := client.Do(req)
+	return flights.do(flightKey(req, fwd), req, func() (*http.Response, error) {
+		return fetchUpstream(req, rule, fwd, key, entry)
+	})
+}
+
+// fetchUpstream sends an upstream request to the origin. If the request can be cached, key is
+// its cache key and entry the stale response in the cache, which the request revalidates.
+func fetchUpstream(req *http.Request, rule ruleset.Rule, fwd *forwardedRequest, key string, entry *cacheEntry) (*http.Response, error) {
+	entry.addValidators(req)
+	addFlareSolverrCookies(req, rule)
+	startTimeout(req)
+
+	client, err := upstreamClient(rule, fwd.jar)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	bodyB, err := io.ReadAll(resp.Body)
+	// the cookies of the rule are sent first, so they win over session cookies of the same name
+	resp, err := client.Do(req)
 	if err != nil {
-		return "", nil, nil, err
+		return nil, err
 	}
 
-	if rule.Headers.CSP != "" {
-		// log.Println(rule.Headers.CSP)
-		resp.Header.Set("Content-Security-Policy", rule.Headers.CSP)
-	} else {
-		resp.Header.Del("Content-Security-Policy")
+	if key != "" {
+		return responses.store(key, entry, resp, rule)
 	}
 
-	// log.Print("rule", rule) TODO: Add a debug mode to print the rule
-	body := rewriteHtml(bodyB, u, rule)
-	return body, req, resp, nil
+	return resp, nil
 }
 
-func rewriteHtml(bodyB []byte, u *url.URL, rule ruleset.Rule) string {
-	// Rewrite the HTML
-	body := string(bodyB)
+// addFlareSolverrCookies adds the cookies of a FlareSolverr solve of the URL to the Cookie
+// of an upstream request, if the rule uses FlareSolverr. The request is sent without them
+// if FlareSolverr fails.
+func addFlareSolverrCookies(req *http.Request, rule ruleset.Rule) {
+	if !rule.UseFlareSolverr || flareSolverrHost == "" {
+		return
+	}
 
-	proxyPrefix := basePath + "/https://" + u.Host + "/"
+	url := req.URL.String()
+	debug := os.Getenv("LOG_URLS") == "true"
+
+	fsCookies, err := getFlareSolverrCookies(url, ruleProxy(rule))
+	if err != nil {
+		if debug {
+			log.Printf("FlareSolverr error for %s: %v", url, err)
+		}
+		return
+	}
+
+	if cookieValue := req.Header.Get("Cookie"); cookieValue != "" {
+		req.Header.Set("Cookie", cookieValue+"; "+fsCookies)
+	} else {
+		req.Header.Set("Cookie", fsCookies)
+	}
+	if debug {
+		log.Printf("Using FlareSolverr cookies for %s", url)
+	}
+}
 
-	// images
-	imagePattern := `<img\s+([^>]*\s+)?src="(/)([^"]*)"`
-	re := regexp.MustCompile(imagePattern)
-	body = re.ReplaceAllString(body, fmt.Sprintf(`<img $1 src="%s$3"`, proxyPrefix))
+// rewriteResponse runs the rewrite pipeline on an upstream body: it rewrites the
+// links of the page u into the proxy and applies the response modifications of the rule.
+func rewriteResponse(bodyB []byte, u *url.URL, resp *http.Response, rule ruleset.Rule, matcher *ruleset.Matcher) (string, error) {
+	var body string
 
-	// scripts
-	scriptPattern := `<script\s+([^>]*\s+)?src="(/)([^"]*)"`
-	reScript := regexp.MustCompile(scriptPattern)
-	body = reScript.ReplaceAllString(body, fmt.Sprintf(`<script $1 script="%s$3"`, proxyPrefix))
+	switch contentType := responseInfo(resp, bodyB).ContentType; {
+	case isHtml(contentType):
+		body = rewriteHtml(bodyB, u, rule, matcher)
+	case isCss(contentType):
+		body = rewriteCss(string(bodyB), u, matcher)
+	default:
+		body = string(bodyB)
+	}
 
-	// body = strings.ReplaceAll(body, "srcset=\"/", "srcset=\""+proxyPrefix) // TODO: Needs a regex to rewrite the URL's
-	body = strings.ReplaceAll(body, "href=\"/", "href=\""+proxyPrefix)
-	body = strings.ReplaceAll(body, "url('/", "url('"+proxyPrefix)
-	body = strings.ReplaceAll(body, "url(/", "url("+proxyPrefix)
-	body = strings.ReplaceAll(body, "href=\"https://"+u.Host, "href=\""+proxyPrefix)
-	return body
+	return modifyResponse(body, bodyB, resp, rule)
 }
 
 func getenv(key, fallback string) string {
@@ -378,59 +712,45 @@ func getenv(key, fallback string) string {
 	return value
 }
 
-func fetchRule(domain string, path string) ruleset.Rule {
-	if len(rulesSet) == 0 {
-		return ruleset.Rule{}
+// methodAllowed reports whether the methods of a rule allow a request method.
+func methodAllowed(method string, rule ruleset.Rule) bool {
+	if len(rule.Methods) == 0 {
+		return true
 	}
-	rule := ruleset.Rule{}
-	for _, rule := range rulesSet {
-		domains := rule.Domains
-		if rule.Domain != "" {
-			domains = append(domains, rule.Domain)
-		}
-		for _, ruleDomain := range domains {
-			if ruleDomain == domain || strings.HasSuffix(domain, ruleDomain) {
-				if len(rule.Paths) > 0 && !StringInSlice(path, rule.Paths) {
-					continue
-				}
-				// return first match
-				return rule
-			}
+
+	for _, m := range rule.Methods {
+		if strings.EqualFold(m, method) || (method == http.MethodHead && strings.EqualFold(m, http.MethodGet)) {
+			return true
 		}
 	}
-	return rule
+
+	return false
 }
 
-func applyRules(body string, rule ruleset.Rule) string {
-	if len(rulesSet) == 0 {
-		return body
+// fetchRule returns the rule of the ruleset that applies to a URL, or an empty rule if there is none.
+func fetchRule(m *ruleset.Matcher, u *url.URL) ruleset.Selection {
+	sel, _ := m.Select(u)
+	return sel
+}
+
+// domainAllowed checks the host of a URL against ALLOWED_DOMAINS and, if ALLOWED_DOMAINS_RULESET
+// is set, whether a rule of the ruleset applies to the URL, including its path matchers.
+// If neither is configured, every domain is allowed.
+func domainAllowed(m *ruleset.Matcher, u *url.URL) bool {
+	if len(allowedDomains) == 0 && !allowRuleDomains {
+		return true
 	}
 
-	for _, regexRule := range rule.RegexRules {
-		re := regexp.MustCompile(regexRule.Match)
-		body = re.ReplaceAllString(body, regexRule.Replace)
+	if StringInSlice(u.Host, allowedDomains) {
+		return true
 	}
-	for _, injection := range rule.Injections {
-		doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
-		if err != nil {
-			log.Fatal(err)
-		}
-		if injection.Replace != "" {
-			doc.Find(injection.Position).ReplaceWithHtml(injection.Replace)
-		}
-		if injection.Append != "" {
-			doc.Find(injection.Position).AppendHtml(injection.Append)
-		}
-		if injection.Prepend != "" {
-			doc.Find(injection.Position).PrependHtml(injection.Prepend)
-		}
-		body, err = doc.Html()
-		if err != nil {
-			log.Fatal(err)
-		}
+
+	if !allowRuleDomains {
+		return false
 	}
 
-	return body
+	_, ok := m.Select(u)
+	return ok
 }
 
 func StringInSlice(s string, list []string) bool {
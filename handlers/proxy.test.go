@@ -46,14 +46,14 @@ func TestRewriteHtml(t *testing.T) {
 			</head>
 			<body>
 				<img src="/https://example.com/image.jpg">
-				<script script="/https://example.com/script.js"></script>
+				<script src="/https://example.com/script.js"></script>
 				<a href="/https://example.com/about">About Us</a>
 				<div style="background-image: url('/https://example.com/background.jpg')"></div>
 			</body>
 		</html>
 	`
 
-	actual := rewriteHtml(bodyB, u, ruleset.Rule{})
+	actual := rewriteHtml(bodyB, u, ruleset.Rule{}, nil)
 	assert.Equal(t, expected, actual)
 }
 
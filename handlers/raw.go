@@ -11,11 +11,17 @@ func Raw(c *fiber.Ctx) error {
 	urlQuery := c.Params("*")
 
 	queries := c.Queries()
-	body, _, _, err := fetchSite(urlQuery, queries)
+	result, err := fetchSite(urlQuery, queries, nil)
 	if err != nil {
 		log.Println("ERROR:", err)
-		c.SendStatus(500)
+		c.SendStatus(errorStatus(err))
 		return c.SendString(err.Error())
 	}
-	return c.SendString(body)
+
+	c.Status(result.resp.StatusCode)
+	if result.stream != nil {
+		return c.SendStream(result.stream, int(result.resp.ContentLength))
+	}
+
+	return c.SendString(result.body)
 }
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"ladder/pkg/ruleset"
+
+	"golang.org/x/net/html"
+)
+
+// maxRedirects is the number of redirects fetchSite follows before it gives up, like http.Client.
+const maxRedirects = 10
+
+// errTooManyRedirects is returned when an upstream redirects more than maxRedirects times.
+// Handlers answer it with 502 Bad Gateway.
+var errTooManyRedirects = errors.New("stopped after too many redirects")
+
+// redirectHop is a redirect that fetchSite followed.
+type redirectHop struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status"`
+	Location   string `json:"location"`
+}
+
+// redirectLocation returns the absolute URL an upstream response redirects to, or nil if it is
+// not a redirect to an HTTP URL.
+func redirectLocation(resp *http.Response) *url.URL {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return nil
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil
+	}
+
+	next, err := resp.Request.URL.Parse(location)
+	if err != nil || (next.Scheme != "http" && next.Scheme != "https") {
+		return nil
+	}
+
+	return next
+}
+
+// followRedirects reports whether redirects of the upstream responses of a rule are followed.
+// Rules that do not set a policy use the REDIRECT_POLICY default.
+func followRedirects(rule ruleset.Rule) bool {
+	policy := rule.Redirects
+	if policy == "" {
+		policy = redirectPolicy
+	}
+
+	return policy != ruleset.RedirectPass
+}
+
+// redirected returns the request to send to the Location of a redirect with the status code.
+// Like browsers, 301 and 302 redirects of a POST, and 303 redirects of anything but HEAD,
+// continue with a GET without a body. 307 and 308 redirects repeat the request.
+func (fwd *forwardedRequest) redirected(status int) *forwardedRequest {
+	switch {
+	case status == http.StatusTemporaryRedirect || status == http.StatusPermanentRedirect:
+		return fwd
+	case status == http.StatusSeeOther && fwd.method != http.MethodHead:
+		return &forwardedRequest{method: http.MethodGet, accept: fwd.accept, jar: fwd.jar}
+	case fwd.method == http.MethodPost:
+		return &forwardedRequest{method: http.MethodGet, accept: fwd.accept, jar: fwd.jar}
+	default:
+		return fwd
+	}
+}
+
+// withBase adds a <base href> to a rewritten HTML document that was fetched through redirects,
+// so the browser and the client runtime resolve URLs against the proxy URL of its final
+// location instead of the requested one. It goes first in <head>, or before the first element
+// of a document without one. Documents that set their own <base href> are left unchanged,
+// rewriteHtml already resolved it into the proxy URL space.
+func withBase(body string, final *url.URL) string {
+	insertAt := -1
+	offset := 0
+
+	z := html.NewTokenizer(strings.NewReader(body))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return body
+			}
+			break
+		}
+
+		raw := len(z.Raw())
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			token := z.Token()
+			switch {
+			case token.Data == "base":
+				if _, ok := attr(token, "href"); ok {
+					return body
+				}
+			case insertAt >= 0, token.Data == "html":
+			case token.Data == "head":
+				insertAt = offset + raw
+			default:
+				insertAt = offset
+			}
+		}
+		offset += raw
+	}
+
+	if insertAt < 0 {
+		return body
+	}
+
+	base := renderTag(html.Token{
+		Type: html.StartTagToken,
+		Data: "base",
+		Attr: []html.Attribute{{Key: "href", Val: proxyUrl(final)}},
+	})
+
+	return body[:insertAt] + base + body[insertAt:]
+}
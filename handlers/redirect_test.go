@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchSiteRedirects(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old", "/moved":
+			http.Redirect(w, r, "/docs/new", http.StatusFound)
+		case "/form":
+			http.Redirect(w, r, "/docs/new", http.StatusSeeOther)
+		case "/renamed":
+			http.Redirect(w, r, "/docs/renamed", http.StatusFound)
+		case "/docs/renamed":
+			http.NotFound(w, r)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(r.Method + " " + r.UserAgent() + ` <a href="page">page</a>`))
+		}
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(`
+- domain: 127.0.0.1
+  paths:
+    - /docs/
+  headers:
+    user-agent: docs-agent
+  urlMods:
+    path:
+      - match: ^/docs/renamed$
+        replace: /docs/new
+- domain: 127.0.0.1
+  paths:
+    - /moved
+  redirects: pass
+`), 0o644)
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+
+	proxy := ProxySite(filepath.Join(dir, "rules.yaml"))
+	app := fiber.New()
+	app.Get("/api/*", Api)
+	app.Get("/*", proxy)
+	app.Post("/*", proxy)
+
+	// followed, with the rule of the new URL, and links resolved against it
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/old", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, `GET docs-agent <base href="/`+upstream.URL+`/docs/new"><a href="/`+upstream.URL+`/docs/page">page</a>`, string(body))
+
+	// the URL of every hop is modified by the rule of its own URL
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/renamed", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), `<base href="/`+upstream.URL+`/docs/renamed">`)
+
+	// a form post continues with a GET
+	resp, err = app.Test(httptest.NewRequest(http.MethodPost, "/"+upstream.URL+"/form", strings.NewReader("a=1")))
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	assert.True(t, strings.HasPrefix(string(body), "GET docs-agent"), string(body))
+
+	// passed to the client in the proxy URL space
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/moved", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, "/"+upstream.URL+"/docs/new", resp.Header.Get("Location"))
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/"+upstream.URL+"/loop", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	// the API reports the hops
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/api/"+upstream.URL+"/old", nil))
+	assert.NoError(t, err)
+	var apiResp Response
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&apiResp))
+	assert.Equal(t, []redirectHop{{URL: upstream.URL + "/old", StatusCode: http.StatusFound, Location: upstream.URL + "/docs/new"}}, apiResp.Redirects)
+}
+
+func TestWithBase(t *testing.T) {
+	final, _ := url.Parse("https://example.com/new?a=1&b=2")
+	base := `<base href="/https://example.com/new?a=1&amp;b=2">`
+
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{`<html><head><title>t</title></head></html>`, `<html><head>` + base + `<title>t</title></head></html>`},
+		{`<!DOCTYPE html><p>text</p>`, `<!DOCTYPE html>` + base + `<p>text</p>`},
+		{`<head><base href="/https://example.com/docs/"></head>`, `<head><base href="/https://example.com/docs/"></head>`},
+		{`text`, `text`},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, withBase(tc.in, final), tc.in)
+	}
+}
+
+func TestFetchSiteKeepsRulesetAcrossRedirects(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	writeRules := func(agent string) {
+		os.WriteFile(path, []byte(`
+- domain: 127.0.0.1
+  headers:
+    user-agent: `+agent+`
+`), 0o644)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			// the ruleset is reloaded between the hops of the request
+			writeRules("agent-v2")
+			assert.NoError(t, rules.Reload())
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(r.UserAgent()))
+	}))
+	defer upstream.Close()
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+	writeRules("agent-v1")
+	ProxySite(path)
+
+	result, err := fetchSite(upstream.URL+"/old", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "agent-v1", result.body)
+
+	result, err = fetchSite(upstream.URL+"/new", nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "agent-v2", result.body)
+}
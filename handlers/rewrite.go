@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"ladder/pkg/ruleset"
+
+	"golang.org/x/net/html"
+)
+
+// urlAttributes are the attributes that contain a single URL, on any element.
+var urlAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"background": true,
+	"data-src":   true,
+	"cite":       true,
+	"manifest":   true,
+}
+
+// srcsetAttributes are the attributes that contain a list of image candidates.
+var srcsetAttributes = map[string]bool{
+	"srcset":      true,
+	"data-srcset": true,
+}
+
+var refreshUrlRegex = regexp.MustCompile(`(?i)^(\s*\d*\.?\d*\s*[;,]\s*(?:url\s*=\s*)?)(['"]?)(.*?)(['"]?)\s*$`)
+
+// rewriteHtml rewrites every URL of an HTML document into the proxy URL space, so that links,
+// resources and forms are loaded through the proxy. URLs are resolved against the page URL u,
+// or the <base href> of the document, keeping their scheme and port.
+// The document is tokenized, not parsed, so everything except the rewritten tags is kept byte for byte.
+// If the rule enables the client runtime, it is loaded first thing in <head>, before any page script.
+// matcher is the ruleset of the request, which decides the domains that are proxied.
+func rewriteHtml(bodyB []byte, u *url.URL, rule ruleset.Rule, matcher *ruleset.Matcher) string {
+	base := *u
+	if base.Scheme == "" {
+		base.Scheme = "https"
+	}
+
+	var out bytes.Buffer
+	out.Grow(len(bodyB))
+
+	z := html.NewTokenizer(bytes.NewReader(bodyB))
+	inStyle := false
+	script := runtimeScript(rule)
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				out.Write(z.Raw())
+			}
+			break
+		}
+
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := string(z.Raw())
+			token := z.Token()
+			inStyle = tt == html.StartTagToken && token.Data == "style"
+
+			if script != "" && token.Data != "html" && token.Data != "head" {
+				// a document without <head>
+				out.WriteString(script)
+				script = ""
+			}
+
+			if token.Data == "base" {
+				if href, ok := attr(token, "href"); ok {
+					if b, err := base.Parse(strings.TrimSpace(href)); err == nil {
+						base = *b
+					}
+				}
+			}
+
+			if rewriteAttributes(&token, &base, matcher) {
+				out.WriteString(renderTag(token))
+			} else {
+				out.WriteString(raw)
+			}
+
+			if script != "" && token.Data == "head" {
+				out.WriteString(script)
+				script = ""
+			}
+		case html.TextToken:
+			if inStyle {
+				out.WriteString(rewriteCss(string(z.Raw()), &base, matcher))
+			} else {
+				out.Write(z.Raw())
+			}
+		case html.EndTagToken:
+			inStyle = false
+			out.Write(z.Raw())
+		default:
+			out.Write(z.Raw())
+		}
+	}
+
+	return out.String()
+}
+
+// rewriteAttributes rewrites the URLs in the attributes of a tag and reports whether any changed.
+func rewriteAttributes(token *html.Token, base *url.URL, matcher *ruleset.Matcher) bool {
+	changed := false
+
+	httpEquiv := ""
+	if token.Data == "meta" {
+		httpEquiv = strings.ToLower(attrOrEmpty(*token, "http-equiv"))
+	}
+
+	for i, a := range token.Attr {
+		if a.Namespace != "" {
+			continue
+		}
+
+		var val string
+		switch {
+		case urlAttributes[a.Key], a.Key == "data" && token.Data == "object":
+			val = rewriteUrl(a.Val, base, matcher)
+		case srcsetAttributes[a.Key]:
+			val = rewriteSrcset(a.Val, base, matcher)
+		case a.Key == "style":
+			val = rewriteCss(a.Val, base, matcher)
+		case a.Key == "content" && httpEquiv == "refresh":
+			val = rewriteRefresh(a.Val, base, matcher)
+		// the document is UTF-8 after decodeCharset
+		case a.Key == "charset" && token.Data == "meta" && !strings.EqualFold(strings.TrimSpace(a.Val), "utf-8"):
+			val = "utf-8"
+		case a.Key == "content" && httpEquiv == "content-type":
+			val = utf8ContentType(a.Val)
+		default:
+			continue
+		}
+
+		if val != a.Val {
+			token.Attr[i].Val = val
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// rewriteUrl resolves a URL against base and returns it in the proxy URL space.
+// Fragments, data:, javascript: and other non-HTTP URLs are returned unchanged, and so are
+// URLs of domains the proxy does not allow under the ruleset of the request, which are only resolved.
+func rewriteUrl(raw string, base *url.URL, matcher *ruleset.Matcher) string {
+	ref := strings.TrimSpace(raw)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return raw
+	}
+
+	abs, err := base.Parse(ref)
+	if err != nil || (abs.Scheme != "http" && abs.Scheme != "https") {
+		return raw
+	}
+
+	if !domainAllowed(matcher, abs) {
+		return abs.String()
+	}
+
+	return proxyUrl(abs)
+}
+
+// proxyUrl returns the URL the proxy serves an absolute upstream URL under.
+func proxyUrl(u *url.URL) string {
+	return basePath + "/" + u.String()
+}
+
+// rewriteSrcset rewrites every candidate URL of a srcset attribute, keeping the descriptors.
+func rewriteSrcset(srcset string, base *url.URL, matcher *ruleset.Matcher) string {
+	candidates := parseSrcset(srcset)
+	for i, c := range candidates {
+		candidates[i].url = rewriteUrl(c.url, base, matcher)
+	}
+
+	return formatSrcset(candidates)
+}
+
+// srcsetCandidate is an image candidate of a srcset attribute, its URL and descriptors.
+type srcsetCandidate struct {
+	url        string
+	descriptor string
+}
+
+// parseSrcset splits a srcset attribute into its candidates like browsers do: a URL runs up
+// to the next whitespace, so it can contain commas, as data: URLs and many image CDN URLs do,
+// and its descriptors run up to the next comma outside parentheses.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+
+	isSpace := func(c byte) bool {
+		return c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r'
+	}
+
+	for i := 0; i < len(srcset); {
+		for i < len(srcset) && (isSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		if i == len(srcset) {
+			break
+		}
+
+		start := i
+		for i < len(srcset) && !isSpace(srcset[i]) {
+			i++
+		}
+		c := srcsetCandidate{url: srcset[start:i]}
+
+		// a URL followed by a comma has no descriptors
+		if trimmed := strings.TrimRight(c.url, ","); trimmed != c.url {
+			c.url = trimmed
+			candidates = append(candidates, c)
+			continue
+		}
+
+		start, depth := i, 0
+	descriptor:
+		for ; i < len(srcset); i++ {
+			switch srcset[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				}
+			case ',':
+				if depth == 0 {
+					break descriptor
+				}
+			}
+		}
+		c.descriptor = strings.Join(strings.Fields(srcset[start:i]), " ")
+		candidates = append(candidates, c)
+	}
+
+	return candidates
+}
+
+// formatSrcset joins candidates into a srcset attribute.
+func formatSrcset(candidates []srcsetCandidate) string {
+	parts := make([]string, len(candidates))
+	for i, c := range candidates {
+		parts[i] = c.url
+		if c.descriptor != "" {
+			parts[i] += " " + c.descriptor
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// utf8ContentType sets the charset of the content of a <meta http-equiv="Content-Type">.
+func utf8ContentType(content string) string {
+	mediaType, params, err := mime.ParseMediaType(content)
+	if err != nil || params["charset"] == "" || strings.EqualFold(params["charset"], "utf-8") {
+		return content
+	}
+	params["charset"] = "utf-8"
+
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// rewriteRefresh rewrites the URL of a <meta http-equiv="refresh" content="5; url=/next">.
+func rewriteRefresh(content string, base *url.URL, matcher *ruleset.Matcher) string {
+	m := refreshUrlRegex.FindStringSubmatch(content)
+	if m == nil || m[3] == "" {
+		return content
+	}
+
+	return m[1] + m[2] + rewriteUrl(m[3], base, matcher) + m[4]
+}
+
+// renderTag renders a start tag. Unlike html.Token.String, attribute values are quoted
+// with the escaping browsers expect, and the tag is kept self-closing if it was.
+func renderTag(token html.Token) string {
+	var b strings.Builder
+
+	b.WriteString("<")
+	b.WriteString(token.Data)
+
+	for _, a := range token.Attr {
+		b.WriteString(" ")
+		if a.Namespace != "" {
+			b.WriteString(a.Namespace)
+			b.WriteString(":")
+		}
+		b.WriteString(a.Key)
+		b.WriteString(`="`)
+		b.WriteString(strings.NewReplacer("&", "&amp;", `"`, "&quot;").Replace(a.Val))
+		b.WriteString(`"`)
+	}
+
+	if token.Type == html.SelfClosingTagToken {
+		b.WriteString("/")
+	}
+	b.WriteString(">")
+
+	return b.String()
+}
+
+// attr returns the value of an attribute of a tag.
+func attr(token html.Token, key string) (string, bool) {
+	for _, a := range token.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val, true
+		}
+	}
+
+	return "", false
+}
+
+func attrOrEmpty(token html.Token, key string) string {
+	val, _ := attr(token, key)
+	return val
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteHtmlUrls(t *testing.T) {
+	u, _ := url.Parse("http://example.com:8080/news/article.html?id=1")
+
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{`<img src="/image.jpg">`, `<img src="/http://example.com:8080/image.jpg">`},
+		{`<img src='photo.jpg' alt=x>`, `<img src="/http://example.com:8080/news/photo.jpg" alt="x">`},
+		{`<script src="/app.js"></script>`, `<script src="/http://example.com:8080/app.js"></script>`},
+		{`<a href="../about?a=1&amp;b=2">`, `<a href="/http://example.com:8080/about?a=1&amp;b=2">`},
+		{`<a href="//cdn.example.org/x">`, `<a href="/http://cdn.example.org/x">`},
+		{`<a href="https://other.org/">`, `<a href="/https://other.org/">`},
+		{`<a href="#top">`, `<a href="#top">`},
+		{`<a href="javascript:void(0)">`, `<a href="javascript:void(0)">`},
+		{`<img src="data:image/png;base64,AAAA">`, `<img src="data:image/png;base64,AAAA">`},
+		{`<form action="/search" method="get">`, `<form action="/http://example.com:8080/search" method="get">`},
+		{`<button formaction="save">`, `<button formaction="/http://example.com:8080/news/save">`},
+		{`<video poster="/poster.jpg"/>`, `<video poster="/http://example.com:8080/poster.jpg"/>`},
+		{`<img data-src="/lazy.jpg">`, `<img data-src="/http://example.com:8080/lazy.jpg">`},
+		{`<img srcset="/a.jpg 1x, b.jpg 2x">`, `<img srcset="/http://example.com:8080/a.jpg 1x, /http://example.com:8080/news/b.jpg 2x">`},
+		{`<img srcset="data:image/png;base64,iVBORw0KGgo= 1x, /b.jpg 2x">`, `<img srcset="data:image/png;base64,iVBORw0KGgo= 1x, /http://example.com:8080/b.jpg 2x">`},
+		{`<img srcset="/img/w_300,c_fill/a.jpg 300w,/img/w_600,c_fill/a.jpg 600w">`, `<img srcset="/http://example.com:8080/img/w_300,c_fill/a.jpg 300w, /http://example.com:8080/img/w_600,c_fill/a.jpg 600w">`},
+		{`<img srcset=" a.jpg,, b.jpg  2x ">`, `<img srcset="/http://example.com:8080/news/a.jpg, /http://example.com:8080/news/b.jpg 2x">`},
+		{`<div style="background: url('/bg.jpg')">`, `<div style="background: url('/http://example.com:8080/bg.jpg')">`},
+		{`<meta http-equiv="refresh" content="5; url=/next">`, `<meta http-equiv="refresh" content="5; url=/http://example.com:8080/next">`},
+		{`<style>body { background: url(/bg.png) }</style>`, `<style>body { background: url(/http://example.com:8080/bg.png) }</style>`},
+		{`<script>var s = "<a href='/x'>";</script>`, `<script>var s = "<a href='/x'>";</script>`},
+		{`<p title="a &lt; b">text &amp; more</p>`, `<p title="a &lt; b">text &amp; more</p>`},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, rewriteHtml([]byte(tc.in), u, ruleset.Rule{}, nil), tc.in)
+	}
+
+	// <base href> changes how the following URLs are resolved
+	in := `<head><base href="https://static.example.com/v2/"></head><img src="logo.png">`
+	want := `<head><base href="/https://static.example.com/v2/"></head><img src="/https://static.example.com/v2/logo.png">`
+	assert.Equal(t, want, rewriteHtml([]byte(in), u, ruleset.Rule{}, nil))
+}
+
+func TestRewriteHtmlInjectsRuntime(t *testing.T) {
+	u, _ := url.Parse("https://example.com/")
+	shim := `<script src="/_ladder/runtime.js"></script>`
+
+	testCases := []struct {
+		rule ruleset.Rule
+		in   string
+		want string
+	}{
+		{ruleset.Rule{}, `<head><title>x</title></head>`, `<head><title>x</title></head>`},
+		{ruleset.Rule{Runtime: ruleset.RuntimeShim}, `<html><head><script src="/app.js"></script></head>`, `<html><head>` + shim + `<script src="/https://example.com/app.js"></script></head>`},
+		{ruleset.Rule{Runtime: ruleset.RuntimeShim}, `<!DOCTYPE html><body><p>x</p>`, `<!DOCTYPE html>` + shim + `<body><p>x</p>`},
+		{ruleset.Rule{Runtime: ruleset.RuntimeServiceWorker}, `<head></head>`, `<head><script src="/_ladder/runtime.js" data-service-worker></script></head>`},
+		{ruleset.Rule{Runtime: ruleset.RuntimeOff}, `<head></head>`, `<head></head>`},
+	}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, rewriteHtml([]byte(tc.in), u, tc.rule, nil), tc.in)
+	}
+
+	// rules without a runtime use the CLIENT_RUNTIME default
+	defer func(r string) { clientRuntime = r }(clientRuntime)
+	clientRuntime = ruleset.RuntimeShim
+	assert.Equal(t, `<head>`+shim+`</head>`, rewriteHtml([]byte(`<head></head>`), u, ruleset.Rule{}, nil))
+	assert.Equal(t, `<head></head>`, rewriteHtml([]byte(`<head></head>`), u, ruleset.Rule{Runtime: ruleset.RuntimeOff}, nil))
+}
+
+func TestRewriteUrlUsesRulesetOfRequest(t *testing.T) {
+	defer func(allow bool) { allowRuleDomains = allow }(allowRuleDomains)
+	allowRuleDomains = true
+
+	// the links of a page are proxied by the ruleset the request started with, not the current one
+	matcher, err := ruleset.NewMatcher(ruleset.RuleSet{{Domain: "example.org"}})
+	assert.NoError(t, err)
+	base, _ := url.Parse("https://example.com/")
+
+	assert.Equal(t, "/https://example.org/a", rewriteUrl("https://example.org/a", base, matcher))
+	assert.Equal(t, "https://other.org/a", rewriteUrl("https://other.org/a", base, matcher))
+}
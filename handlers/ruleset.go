@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"context"
+	"log"
 	"os"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"gopkg.in/yaml.v3"
@@ -13,7 +16,7 @@ func Ruleset(c *fiber.Ctx) error {
 		return c.SendString("Rules Disabled")
 	}
 
-	body, err := yaml.Marshal(rulesSet)
+	body, err := yaml.Marshal(rules.Current().RuleSet())
 	if err != nil {
 		c.SendStatus(fiber.StatusInternalServerError)
 		return c.SendString(err.Error())
@@ -21,3 +24,26 @@ func Ruleset(c *fiber.Ctx) error {
 
 	return c.SendString(string(body))
 }
+
+// ReloadRuleset reloads every source of the ruleset, whether it changed or not.
+func ReloadRuleset() error {
+	return rules.Reload()
+}
+
+// WatchRuleset reloads the ruleset whenever one of its sources changes.
+// Sources are checked every RULESET_RELOAD_INTERVAL (e.g. `30s`); watching is
+// disabled if the variable is not set.
+func WatchRuleset(ctx context.Context) {
+	interval := os.Getenv("RULESET_RELOAD_INTERVAL")
+	if interval == "" {
+		return
+	}
+
+	d, err := time.ParseDuration(interval)
+	if err != nil || d <= 0 {
+		log.Printf("WARN: invalid RULESET_RELOAD_INTERVAL '%s', ruleset reloading disabled", interval)
+		return
+	}
+
+	go rules.Watch(ctx, d)
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// RuleTestResult is the outcome of a single ruleset.RuleTest.
+type RuleTestResult struct {
+	Name     string
+	Failures []string
+}
+
+// Passed reports whether all expectations of the test were met.
+func (r RuleTestResult) Passed() bool {
+	return len(r.Failures) == 0
+}
+
+// RunRuleTests runs the tests of every rule in the RuleSet offline.
+// The rule for a test is selected from the whole RuleSet by the test URL,
+// exactly as it would be for a proxied request.
+func RunRuleTests(rs ruleset.RuleSet) ([]RuleTestResult, error) {
+	m, err := ruleset.NewMatcher(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []RuleTestResult
+
+	for _, rule := range rs {
+		for _, tc := range rule.Tests {
+			name := tc.Name
+			if name == "" {
+				name = tc.URL
+			}
+
+			results = append(results, RuleTestResult{
+				Name:     rule.Source() + ": " + name,
+				Failures: runRuleTest(m, rule.Source(), tc),
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// runRuleTest runs the rewrite pipeline on the fixture of a test and returns the failed expectations.
+func runRuleTest(m *ruleset.Matcher, source string, tc ruleset.RuleTest) []string {
+	u, err := url.Parse(tc.URL)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid url: %s", err)}
+	}
+
+	sel, ok := m.Select(u)
+	rule := sel.Rule
+	if !ok {
+		return []string{fmt.Sprintf("no rule matches %s", tc.URL)}
+	}
+
+	var failures []string
+	fail := func(format string, args ...any) {
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+
+	upstreamURL, err := modifyURL(tc.URL, rule)
+	if err != nil {
+		return []string{fmt.Sprintf("failed to modify url: %s", err)}
+	}
+
+	if tc.Expect.URL != "" && upstreamURL != tc.Expect.URL {
+		fail("expected upstream url %s, got %s", tc.Expect.URL, upstreamURL)
+	}
+
+	fixture := []byte(tc.HTML)
+	if tc.File != "" {
+		fixture, err = os.ReadFile(filepath.Join(filepath.Dir(source), tc.File))
+		if err != nil {
+			return append(failures, fmt.Sprintf("failed to read fixture: %s", err))
+		}
+	}
+
+	if len(fixture) == 0 {
+		return failures
+	}
+
+	contentType := tc.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	upstream, _ := url.Parse(upstreamURL)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Request:    &http.Request{Method: http.MethodGet, URL: upstream},
+	}
+
+	body, err := rewriteResponse(fixture, u, resp, rule, m)
+	if err != nil {
+		return append(failures, fmt.Sprintf("rewrite failed: %s", err))
+	}
+
+	for _, s := range tc.Expect.Contains {
+		if !strings.Contains(body, s) {
+			fail("expected body to contain %q", s)
+		}
+	}
+
+	for _, s := range tc.Expect.NotContains {
+		if strings.Contains(body, s) {
+			fail("expected body not to contain %q", s)
+		}
+	}
+
+	if len(tc.Expect.Present)+len(tc.Expect.Absent)+len(tc.Expect.Text) == 0 {
+		return failures
+	}
+
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(body))
+	if err != nil {
+		return append(failures, fmt.Sprintf("failed to parse result: %s", err))
+	}
+
+	for _, sel := range tc.Expect.Present {
+		if doc.Find(sel).Length() == 0 {
+			fail("expected %s to be present", sel)
+		}
+	}
+
+	for _, sel := range tc.Expect.Absent {
+		if n := doc.Find(sel).Length(); n > 0 {
+			fail("expected %s to be absent, found %d", sel, n)
+		}
+	}
+
+	text := doc.Text()
+	for _, s := range tc.Expect.Text {
+		if !strings.Contains(text, s) {
+			fail("expected text to contain %q", s)
+		}
+	}
+
+	return failures
+}
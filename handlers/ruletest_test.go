@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunRuleTests(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "fixture.html"), []byte(`<html><head></head><body><h1>Title</h1></body></html>`), 0o644)
+	os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(`
+- domain: example.com
+  urlMods:
+    query:
+      - key: amp
+        value: 1
+  injections:
+    - position: h1
+      replace: <h1 class="replaced">Replaced</h1>
+  tests:
+    - name: passing
+      url: https://www.example.com/article
+      file: fixture.html
+      expect:
+        url: https://www.example.com/article?amp=1
+        present:
+          - h1.replaced
+        text:
+          - Replaced
+    - name: failing
+      url: https://www.example.com/article
+      html: <html><body><h1>Title</h1></body></html>
+      expect:
+        url: https://www.example.com/article
+        absent:
+          - h1
+        contains:
+          - Title
+`), 0o644)
+
+	rs, err := ruleset.NewRuleset(filepath.Join(dir, "rules.yaml"))
+	assert.NoError(t, err)
+
+	results, err := RunRuleTests(rs)
+	assert.NoError(t, err)
+	if !assert.Len(t, results, 2) {
+		return
+	}
+
+	assert.True(t, results[0].Passed(), results[0].Failures)
+	assert.False(t, results[1].Passed())
+	assert.Equal(t, []string{
+		"expected upstream url https://www.example.com/article, got https://www.example.com/article?amp=1",
+		`expected body to contain "Title"`,
+		"expected h1 to be absent, found 1",
+	}, results[1].Failures)
+}
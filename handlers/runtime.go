@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	_ "embed"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+//go:embed runtime.js
+var runtimeJs []byte
+
+//go:embed sw.js
+var serviceWorkerJs []byte
+
+// Runtime serves the client runtime that rewriteHtml injects into proxied pages.
+func Runtime(c *fiber.Ctx) error {
+	c.Set("Content-Type", "text/javascript; charset=utf-8")
+	c.Set("Cache-Control", "public, max-age=3600")
+
+	return c.Send(runtimeJs)
+}
+
+// ServiceWorker serves the service worker registered by the client runtime. It is allowed to
+// control every page of the proxy, not just those under its own path.
+func ServiceWorker(c *fiber.Ctx) error {
+	c.Set("Content-Type", "text/javascript; charset=utf-8")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Service-Worker-Allowed", basePath+"/")
+
+	return c.Send(serviceWorkerJs)
+}
+
+// runtimeScript returns the script tag that loads the client runtime of a rule, or "" if the
+// runtime is off. Rules that do not set a runtime use the CLIENT_RUNTIME default.
+func runtimeScript(rule ruleset.Rule) string {
+	runtime := rule.Runtime
+	if runtime == "" {
+		runtime = clientRuntime
+	}
+
+	switch runtime {
+	case ruleset.RuntimeShim:
+		return `<script src="` + basePath + `/_ladder/runtime.js"></script>`
+	case ruleset.RuntimeServiceWorker:
+		return `<script src="` + basePath + `/_ladder/runtime.js" data-service-worker></script>`
+	default:
+		return ""
+	}
+}
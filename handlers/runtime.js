@@ -0,0 +1,263 @@
+// The ladder client runtime maps the URLs that scripts build at runtime into the proxy URL
+// space, like rewriteHtml does for the URLs written in the document. ladder loads it as the
+// first script of proxied pages when the `runtime` of their rule is shim or serviceWorker.
+(() => {
+  "use strict";
+
+  if (window.__ladderRuntime) {
+    return;
+  }
+  window.__ladderRuntime = true;
+
+  const script = document.currentScript;
+  const origin = location.origin;
+  const prefix = new URL(script.src).pathname.replace(/\/_ladder\/runtime\.js$/, "");
+
+  // upstreamUrl returns the upstream URL of a URL in the proxy URL space, or null.
+  const upstreamUrl = (u) => {
+    if (u.origin !== origin || !u.pathname.startsWith(prefix + "/")) {
+      return null;
+    }
+
+    const path = u.pathname.slice(prefix.length + 1);
+    if (!/^https?:\/\//i.test(path)) {
+      return null;
+    }
+
+    try {
+      return new URL(path + u.search + u.hash);
+    } catch {
+      return null;
+    }
+  };
+
+  // baseUrl returns the upstream URL that relative URLs are resolved against.
+  const baseUrl = () => upstreamUrl(new URL(document.baseURI)) || upstreamUrl(new URL(location.href));
+
+  // proxyUrl maps a URL into the proxy URL space. Fragments, data:, blob:, javascript: and
+  // other non-HTTP URLs, and URLs that already are in the proxy URL space, are returned unchanged.
+  const proxyUrl = (url) => {
+    if (url === null || url === undefined) {
+      return url;
+    }
+
+    const s = String(url).trim();
+    const base = baseUrl();
+    if (s === "" || s.startsWith("#") || !base) {
+      return url;
+    }
+
+    let u;
+    try {
+      if (s.startsWith("/") && !s.startsWith("//")) {
+        // root-relative URLs may already be proxied, like those written by rewriteHtml
+        const own = new URL(s, origin);
+        if (upstreamUrl(own)) {
+          return own.href;
+        }
+      }
+
+      u = new URL(s, base);
+    } catch {
+      return url;
+    }
+
+    if (u.origin === origin) {
+      if (upstreamUrl(u)) {
+        return u.href;
+      }
+      // an absolute URL of the proxy built from location.origin belongs to the upstream
+      u = new URL(u.pathname + u.search + u.hash, base);
+    }
+
+    if (u.protocol !== "http:" && u.protocol !== "https:") {
+      return url;
+    }
+
+    return origin + prefix + "/" + u.href;
+  };
+
+  // the same tokenizer as parseSrcset in rewrite.go: a URL runs up to the next whitespace,
+  // so it can contain commas, and its descriptors up to the next comma outside parentheses
+  const parseSrcset = (srcset) => {
+    const candidates = [];
+    const isSpace = (c) => " \t\n\f\r".includes(c);
+
+    let i = 0;
+    while (i < srcset.length) {
+      while (i < srcset.length && (isSpace(srcset[i]) || srcset[i] === ",")) {
+        i++;
+      }
+      if (i === srcset.length) {
+        break;
+      }
+
+      let start = i;
+      while (i < srcset.length && !isSpace(srcset[i])) {
+        i++;
+      }
+      const url = srcset.slice(start, i);
+
+      // a URL followed by a comma has no descriptors
+      const trimmed = url.replace(/,+$/, "");
+      if (trimmed !== url) {
+        candidates.push({ url: trimmed, descriptor: "" });
+        continue;
+      }
+
+      start = i;
+      let depth = 0;
+      for (; i < srcset.length; i++) {
+        const c = srcset[i];
+        if (c === "(") {
+          depth++;
+        } else if (c === ")" && depth > 0) {
+          depth--;
+        } else if (c === "," && depth === 0) {
+          break;
+        }
+      }
+      const descriptor = srcset.slice(start, i).trim().split(/[ \t\n\f\r]+/).join(" ");
+      candidates.push({ url, descriptor });
+    }
+
+    return candidates;
+  };
+
+  const proxySrcset = (srcset) =>
+    parseSrcset(String(srcset))
+      .map(({ url, descriptor }) => (descriptor ? proxyUrl(url) + " " + descriptor : proxyUrl(url)))
+      .join(", ");
+
+  // the same attributes as urlAttributes and srcsetAttributes in rewrite.go
+  const urlAttributes = new Set(["href", "src", "action", "formaction", "poster", "background", "data-src", "cite", "manifest"]);
+  const srcsetAttributes = new Set(["srcset", "data-srcset"]);
+
+  const proxyAttribute = (element, name, value) => {
+    name = String(name).toLowerCase();
+    if (urlAttributes.has(name) || (name === "data" && element.localName === "object")) {
+      return proxyUrl(value);
+    }
+    if (srcsetAttributes.has(name)) {
+      return proxySrcset(value);
+    }
+    return value;
+  };
+
+  // fetch
+  const fetch = window.fetch;
+  window.fetch = function (input, init) {
+    if (input instanceof Request) {
+      const url = proxyUrl(input.url);
+      if (url !== input.url) {
+        input = new Request(url, input);
+      }
+    } else {
+      input = proxyUrl(input);
+    }
+    return fetch.call(this, input, init);
+  };
+
+  // XMLHttpRequest
+  const open = XMLHttpRequest.prototype.open;
+  XMLHttpRequest.prototype.open = function (method, url, ...rest) {
+    return open.call(this, method, proxyUrl(url), ...rest);
+  };
+
+  // history.pushState and replaceState throw for URLs of another origin
+  for (const name of ["pushState", "replaceState"]) {
+    const original = History.prototype[name];
+    History.prototype[name] = function (state, unused, url) {
+      if (url === undefined || url === null) {
+        return original.call(this, state, unused);
+      }
+      return original.call(this, state, unused, proxyUrl(url));
+    };
+  }
+
+  // window.open
+  const windowOpen = window.open;
+  window.open = function (url, ...rest) {
+    return windowOpen.call(this, url === undefined ? url : proxyUrl(url), ...rest);
+  };
+
+  // Element.setAttribute and the URL properties of elements
+  const setAttribute = Element.prototype.setAttribute;
+  Element.prototype.setAttribute = function (name, value) {
+    return setAttribute.call(this, name, proxyAttribute(this, name, value));
+  };
+
+  const setAttributeNS = Element.prototype.setAttributeNS;
+  Element.prototype.setAttributeNS = function (namespace, name, value) {
+    return setAttributeNS.call(this, namespace, name, namespace ? value : proxyAttribute(this, name, value));
+  };
+
+  const patchProperty = (type, property, map) => {
+    const proto = window[type] && window[type].prototype;
+    const descriptor = proto && Object.getOwnPropertyDescriptor(proto, property);
+    if (!descriptor || !descriptor.set) {
+      return;
+    }
+
+    Object.defineProperty(proto, property, {
+      ...descriptor,
+      set(value) {
+        descriptor.set.call(this, map(value));
+      },
+    });
+  };
+
+  for (const [type, property] of [
+    ["HTMLAnchorElement", "href"],
+    ["HTMLAreaElement", "href"],
+    ["HTMLLinkElement", "href"],
+    ["HTMLBaseElement", "href"],
+    ["HTMLImageElement", "src"],
+    ["HTMLScriptElement", "src"],
+    ["HTMLIFrameElement", "src"],
+    ["HTMLFrameElement", "src"],
+    ["HTMLEmbedElement", "src"],
+    ["HTMLSourceElement", "src"],
+    ["HTMLTrackElement", "src"],
+    ["HTMLMediaElement", "src"],
+    ["HTMLInputElement", "src"],
+    ["HTMLVideoElement", "poster"],
+    ["HTMLObjectElement", "data"],
+    ["HTMLFormElement", "action"],
+    ["HTMLButtonElement", "formAction"],
+    ["HTMLInputElement", "formAction"],
+  ]) {
+    patchProperty(type, property, proxyUrl);
+  }
+  patchProperty("HTMLImageElement", "srcset", proxySrcset);
+  patchProperty("HTMLSourceElement", "srcset", proxySrcset);
+
+  // location cannot be patched, but where the Navigation API is supported, navigations that
+  // would leave the proxy, like `location.href = url`, are cancelled and sent through it instead
+  if (window.navigation) {
+    window.navigation.addEventListener("navigate", (event) => {
+      if (!event.cancelable || event.hashChange || event.formData || event.downloadRequest !== null) {
+        return;
+      }
+
+      const destination = event.destination.url;
+      if (upstreamUrl(new URL(destination))) {
+        return;
+      }
+
+      const url = proxyUrl(destination);
+      if (url === destination) {
+        return;
+      }
+
+      event.preventDefault();
+      window.navigation.navigate(url, { history: event.navigationType === "replace" ? "replace" : "auto" });
+    });
+  }
+
+  if (script.hasAttribute("data-service-worker") && "serviceWorker" in navigator) {
+    navigator.serviceWorker.register(prefix + "/_ladder/sw.js", { scope: prefix + "/" }).catch((err) => {
+      console.debug("ladder: service worker not registered:", err);
+    });
+  }
+})();
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/net/publicsuffix"
+)
+
+// sessionCookie is the ladder cookie that identifies the session of a client.
+const sessionCookie = "ladder_session"
+
+// maxSessions limits the number of sessions kept in memory. When it is reached, new clients
+// get no session until old sessions expire.
+const maxSessions = 10000
+
+var (
+	sessionsEnabled = os.Getenv("COOKIE_SESSIONS") == "true"
+	sessionTTL      = 24 * time.Hour
+	sessions        = &sessionStore{sessions: map[string]*session{}}
+)
+
+func init() {
+	if ttl, err := time.ParseDuration(os.Getenv("SESSION_TTL")); err == nil && ttl > 0 {
+		sessionTTL = ttl
+	}
+}
+
+// session is the server-side cookie jar of a client. Upstream cookies are kept in the session
+// instead of being passed to the client, and sent again on the following upstream requests.
+type session struct {
+	jar *cookiejar.Jar
+
+	mu       sync.Mutex
+	origins  map[string]*url.URL // the upstream origins that set cookies, to list them
+	lastUsed time.Time
+}
+
+// sessionStore holds the sessions of all clients by their id.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+func newSession() *session {
+	// the public suffix list keeps upstreams from setting cookies for a whole TLD
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+
+	return &session{jar: jar, origins: map[string]*url.URL{}, lastUsed: time.Now()}
+}
+
+// SetCookies implements http.CookieJar.
+func (s *session) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	s.jar.SetCookies(u, cookies)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	origin := &url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}
+	s.origins[origin.String()] = origin
+}
+
+// Cookies implements http.CookieJar.
+func (s *session) Cookies(u *url.URL) []*http.Cookie {
+	return s.jar.Cookies(u)
+}
+
+// hasCookies reports whether an upstream set any cookies in the session.
+func (s *session) hasCookies() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.origins) > 0
+}
+
+// sessionCookieInfo is a cookie of a session, as reported by the session endpoints.
+type sessionCookieInfo struct {
+	URL   string `json:"url"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// list returns the cookies the session sends to the root path of every upstream origin that
+// set cookies. Cookies restricted to a path below the root are not listed.
+func (s *session) list() []sessionCookieInfo {
+	s.mu.Lock()
+	origins := make([]*url.URL, 0, len(s.origins))
+	for _, origin := range s.origins {
+		origins = append(origins, origin)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(origins, func(i, j int) bool { return origins[i].String() < origins[j].String() })
+
+	list := []sessionCookieInfo{}
+	for _, origin := range origins {
+		for _, cookie := range s.jar.Cookies(origin) {
+			list = append(list, sessionCookieInfo{URL: origin.String(), Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+
+	return list
+}
+
+// get returns the session with the id, or nil if there is none or it expired.
+func (st *sessionStore) get(id string) *session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s := st.sessions[id]
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastUsed) > sessionTTL {
+		delete(st.sessions, id)
+		return nil
+	}
+	s.lastUsed = time.Now()
+
+	return s
+}
+
+// add stores a new session and returns its id, or "" if the store is full.
+// Expired sessions are removed first.
+func (st *sessionStore) add(s *session) string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for id, other := range st.sessions {
+		other.mu.Lock()
+		if time.Since(other.lastUsed) > sessionTTL {
+			delete(st.sessions, id)
+		}
+		other.mu.Unlock()
+	}
+
+	if len(st.sessions) >= maxSessions {
+		return ""
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(b)
+	st.sessions[id] = s
+
+	return id
+}
+
+// remove deletes a session and reports whether it existed.
+func (st *sessionStore) remove(id string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	_, ok := st.sessions[id]
+	delete(st.sessions, id)
+
+	return ok
+}
+
+// clientSession returns the session of the client of a request, or a new session that is
+// only stored by saveSession if an upstream sets a cookie in it. It returns nil if
+// COOKIE_SESSIONS is not enabled.
+func clientSession(c *fiber.Ctx) *session {
+	if !sessionsEnabled {
+		return nil
+	}
+
+	if s := sessions.get(c.Cookies(sessionCookie)); s != nil {
+		return s
+	}
+
+	return newSession()
+}
+
+// saveSession stores a new session that holds cookies, and sets the ladder cookie that
+// identifies it on the response.
+func saveSession(c *fiber.Ctx, s *session) {
+	if s == nil || !s.hasCookies() || sessions.get(c.Cookies(sessionCookie)) == s {
+		return
+	}
+
+	id := sessions.add(s)
+	if id == "" {
+		return
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     basePath + "/",
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// Session lists the upstream cookies of the session of the client.
+func Session(c *fiber.Ctx) error {
+	return sendSession(c, c.Cookies(sessionCookie))
+}
+
+// ClearSession deletes the session of the client with all its upstream cookies.
+func ClearSession(c *fiber.Ctx) error {
+	// the cookie is only replaced by one with the same path as the one saveSession set
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookie,
+		Path:     basePath + "/",
+		Expires:  time.Unix(0, 0),
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return clearSession(c, c.Cookies(sessionCookie))
+}
+
+// AdminSession lists the upstream cookies of any session.
+func AdminSession(c *fiber.Ctx) error {
+	return sendSession(c, c.Params("id"))
+}
+
+// AdminClearSession deletes any session with all its upstream cookies.
+func AdminClearSession(c *fiber.Ctx) error {
+	return clearSession(c, c.Params("id"))
+}
+
+func sendSession(c *fiber.Ctx, id string) error {
+	if !sessionsEnabled {
+		c.SendStatus(fiber.StatusNotFound)
+		return c.SendString("Cookie Sessions Disabled")
+	}
+
+	s := sessions.get(id)
+	if s == nil {
+		c.SendStatus(fiber.StatusNotFound)
+		return c.SendString("Session Not Found")
+	}
+
+	return c.JSON(fiber.Map{
+		"cookies": s.list(),
+	})
+}
+
+func clearSession(c *fiber.Ctx, id string) error {
+	if !sessionsEnabled {
+		c.SendStatus(fiber.StatusNotFound)
+		return c.SendString("Cookie Sessions Disabled")
+	}
+
+	if !sessions.remove(id) {
+		c.SendStatus(fiber.StatusNotFound)
+		return c.SendString("Session Not Found")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ladder/pkg/ruleset"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieSessions(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "abc", Path: "/"})
+			http.Redirect(w, r, "/account", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(r.Header.Get("Cookie")))
+		}
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(`
+- domain: 127.0.0.1
+  headers:
+    cookie: consent=yes
+`), 0o644)
+
+	defer func(r *ruleset.Reloader) { rules = r }(rules)
+	defer func(enabled bool) { sessionsEnabled = enabled }(sessionsEnabled)
+	sessionsEnabled = true
+
+	app := fiber.New()
+	app.Get("/_ladder/session", Session)
+	app.Delete("/_ladder/session", ClearSession)
+	app.Get("/*", ProxySite(filepath.Join(dir, "rules.yaml")))
+
+	get := func(path string, cookie *http.Cookie) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		resp, err := app.Test(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// no session cookies, no session
+	resp := get("/"+upstream.URL+"/account", nil)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, "consent=yes", string(body))
+	assert.Empty(t, resp.Cookies())
+
+	// the cookie is kept across the redirect and in a new session, merged with the rule cookie
+	resp = get("/"+upstream.URL+"/login", nil)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "consent=yes; sid=abc", string(body))
+	if !assert.Len(t, resp.Cookies(), 1) {
+		return
+	}
+	cookie := resp.Cookies()[0]
+	assert.Equal(t, sessionCookie, cookie.Name)
+	assert.True(t, cookie.HttpOnly)
+
+	resp = get("/"+upstream.URL+"/account", cookie)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "consent=yes; sid=abc", string(body))
+	assert.Empty(t, resp.Cookies())
+
+	resp = get("/_ladder/session", cookie)
+	var info struct {
+		Cookies []sessionCookieInfo `json:"cookies"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+	assert.Equal(t, []sessionCookieInfo{{URL: upstream.URL + "/", Name: "sid", Value: "abc"}}, info.Cookies)
+
+	req := httptest.NewRequest(http.MethodDelete, "/_ladder/session", nil)
+	req.AddCookie(cookie)
+	resp, err := app.Test(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	// the ladder cookie is expired on the path it was set on
+	if assert.Len(t, resp.Cookies(), 1) {
+		assert.Equal(t, sessionCookie, resp.Cookies()[0].Name)
+		assert.Equal(t, cookie.Path, resp.Cookies()[0].Path)
+		assert.True(t, resp.Cookies()[0].Expires.Before(time.Now()))
+	}
+
+	resp = get("/"+upstream.URL+"/account", cookie)
+	body, _ = io.ReadAll(resp.Body)
+	assert.Equal(t, "consent=yes", string(body))
+}
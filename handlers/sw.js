@@ -0,0 +1,84 @@
+// The ladder service worker routes the requests of proxied pages through the proxy, including
+// those the client runtime cannot patch, like requests of workers, CSS and modules imported by
+// scripts. It is registered by the client runtime when the `runtime` of a rule is serviceWorker.
+"use strict";
+
+const origin = self.location.origin;
+const prefix = new URL(self.location.href).pathname.replace(/\/_ladder\/sw\.js$/, "");
+
+// paths served by ladder itself, see cmd/main.go. Any other path of the proxy is a
+// root-relative URL of a proxied page, which ProxySite resolves against the referer.
+const ownPath = /^\/(?:$|styles\.css$|favicon\.ico$|ruleset$|raw\/|api(?:\/|$)|admin\/|_ladder\/)/;
+
+self.addEventListener("install", () => self.skipWaiting());
+self.addEventListener("activate", (event) => event.waitUntil(self.clients.claim()));
+
+// upstreamUrl returns the upstream URL of a URL in the proxy URL space, or null.
+const upstreamUrl = (u) => {
+  if (u.origin !== origin || !u.pathname.startsWith(prefix + "/")) {
+    return null;
+  }
+
+  const path = u.pathname.slice(prefix.length + 1);
+  if (!/^https?:\/\//i.test(path)) {
+    return null;
+  }
+
+  try {
+    return new URL(path + u.search + u.hash);
+  } catch {
+    return null;
+  }
+};
+
+// pageUrl returns the upstream URL of the page that made a request, or null.
+const pageUrl = async (event) => {
+  const client = event.clientId ? await self.clients.get(event.clientId) : null;
+  const page = client ? client.url : event.request.referrer;
+
+  return page ? upstreamUrl(new URL(page)) : null;
+};
+
+// forward sends a request to another URL, keeping its method, headers and body.
+const forward = async (request, url) => {
+  const init = {
+    method: request.method,
+    headers: request.headers,
+    credentials: "same-origin",
+    redirect: request.mode === "navigate" ? "manual" : request.redirect,
+    signal: request.signal,
+  };
+  if (request.method !== "GET" && request.method !== "HEAD") {
+    init.body = await request.blob();
+  }
+
+  return fetch(url, init);
+};
+
+self.addEventListener("fetch", (event) => {
+  const url = new URL(event.request.url);
+  if (url.protocol !== "http:" && url.protocol !== "https:") {
+    return;
+  }
+
+  if (url.origin !== origin) {
+    event.respondWith(forward(event.request, origin + prefix + "/" + url.href));
+    return;
+  }
+
+  if (upstreamUrl(url) || !url.pathname.startsWith(prefix + "/") || ownPath.test(url.pathname.slice(prefix.length))) {
+    return;
+  }
+
+  event.respondWith(
+    (async () => {
+      const page = await pageUrl(event);
+      if (!page) {
+        return fetch(event.request);
+      }
+
+      const upstream = new URL(url.pathname.slice(prefix.length) + url.search, page);
+      return forward(event.request, origin + prefix + "/" + upstream.href);
+    })(),
+  );
+});
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ladder/pkg/outbound"
+	"ladder/pkg/ruleset"
+)
+
+// errUpstreamTimeout is returned when an upstream request exceeds the Timeout of its rule.
+// Handlers answer it with 504 Gateway Timeout.
+var errUpstreamTimeout = errors.New("upstream request timed out")
+
+// maxIdleConns limits the idle connections kept open to all upstreams together.
+const maxIdleConns = 256
+
+// defaultTransport holds the connection settings of upstream requests whose rule does not
+// override them. A ResponseHeaderTimeout of zero leaves the wait for the response headers
+// to Timeout.
+var defaultTransport = ruleset.Transport{
+	DialTimeout:         10 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	Timeout:             15 * time.Second,
+	StreamIdleTimeout:   time.Minute,
+	StreamTimeout:       time.Hour,
+	MaxIdleConnsPerHost: 16,
+}
+
+// upstreamProxy is the outbound proxy of upstream requests whose rule does not set one.
+var upstreamProxy = outbound.FromEnv()
+
+// transportKey identifies the transports that can be shared.
+type transportKey struct {
+	settings ruleset.Transport
+	proxy    string
+}
+
+var (
+	transportsMu sync.Mutex
+	// transports are shared by all requests with the same settings, so connections are reused
+	transports = map[transportKey]*http.Transport{}
+)
+
+func init() {
+	// an invalid proxy must not silently send the requests it should carry without it
+	if _, err := outbound.Parse(upstreamProxy); err != nil {
+		log.Fatalf("UPSTREAM_PROXY: %s", err)
+	}
+
+	durations := map[string]*time.Duration{
+		"HTTP_DIAL_TIMEOUT":            &defaultTransport.DialTimeout,
+		"HTTP_TLS_HANDSHAKE_TIMEOUT":   &defaultTransport.TLSHandshakeTimeout,
+		"HTTP_RESPONSE_HEADER_TIMEOUT": &defaultTransport.ResponseHeaderTimeout,
+		"HTTP_TIMEOUT":                 &defaultTransport.Timeout,
+		"HTTP_STREAM_IDLE_TIMEOUT":     &defaultTransport.StreamIdleTimeout,
+		"HTTP_STREAM_TIMEOUT":          &defaultTransport.StreamTimeout,
+	}
+	for key, dst := range durations {
+		if d := parseDuration(os.Getenv(key)); d > 0 {
+			*dst = d
+		}
+	}
+
+	limits := map[string]*int{
+		"HTTP_MAX_IDLE_CONNS_PER_HOST": &defaultTransport.MaxIdleConnsPerHost,
+		"HTTP_MAX_CONNS_PER_HOST":      &defaultTransport.MaxConnsPerHost,
+	}
+	for key, dst := range limits {
+		if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+			*dst = n
+		}
+	}
+
+	defaultTransport.DisableHTTP2 = os.Getenv("HTTP_DISABLE_HTTP2") == "true"
+}
+
+// parseDuration parses a duration like 5s, or a number of seconds, and returns 0 if it is invalid.
+func parseDuration(s string) time.Duration {
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	d, _ := time.ParseDuration(s)
+	return d
+}
+
+// upstreamTimeout bounds an upstream request, from sending it until its body is read, by the
+// Timeout of its rule. A body that is streamed to the client, such as a large download, is
+// bounded by the StreamIdleTimeout, which restarts on every read, and the StreamTimeout
+// instead, once fetchSite starts streaming it.
+type upstreamTimeout struct {
+	settings ruleset.Transport
+	deadline time.Time // the end of the StreamTimeout of a streamed body
+	timer    *time.Timer
+	cancel   context.CancelFunc
+	expired  atomic.Bool
+}
+
+// timeoutKey is the context key of the upstreamTimeout of a request.
+type timeoutKey struct{}
+
+// withTimeout returns the request with a context that is cancelled when the Timeout of the
+// rule expires. The Timeout starts when the request is sent, see startTimeout, so it does not
+// count waiting for a FlareSolverr solve. The caller must call done once it is finished with
+// the response.
+func withTimeout(req *http.Request, rule ruleset.Rule) (*http.Request, *upstreamTimeout) {
+	ctx, cancel := context.WithCancel(req.Context())
+	t := &upstreamTimeout{
+		settings: rule.Transport.WithDefaults(defaultTransport),
+		cancel:   cancel,
+	}
+	t.timer = time.AfterFunc(t.settings.Timeout, func() {
+		t.expired.Store(true)
+		cancel()
+	})
+	t.timer.Stop()
+
+	return req.WithContext(context.WithValue(ctx, timeoutKey{}, t)), t
+}
+
+// startTimeout starts the Timeout of a request made with withTimeout, when it is sent upstream.
+func startTimeout(req *http.Request) {
+	if t, ok := req.Context().Value(timeoutKey{}).(*upstreamTimeout); ok {
+		t.timer.Reset(t.settings.Timeout)
+	}
+}
+
+// stream switches to the timeouts of a streamed body.
+func (t *upstreamTimeout) stream() {
+	t.deadline = time.Now().Add(t.settings.StreamTimeout)
+	t.extend()
+}
+
+// extend restarts the StreamIdleTimeout of a streamed body, within its StreamTimeout.
+func (t *upstreamTimeout) extend() {
+	t.timer.Reset(min(t.settings.StreamIdleTimeout, time.Until(t.deadline)))
+}
+
+// done ends the timeout and releases the request.
+func (t *upstreamTimeout) done() {
+	t.timer.Stop()
+	t.cancel()
+}
+
+// wrap returns an error of the request, naming the timeout if it expired.
+func (t *upstreamTimeout) wrap(err error) error {
+	if err == nil || !t.expired.Load() {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", errUpstreamTimeout, err)
+}
+
+// streamedBody is a streamed upstream body that keeps its timeout while data arrives, and
+// releases its request when it is closed.
+type streamedBody struct {
+	io.ReadCloser
+	timeout *upstreamTimeout
+}
+
+func (b *streamedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timeout.extend()
+	}
+
+	return n, b.timeout.wrap(err)
+}
+
+func (b *streamedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.timeout.done()
+
+	return err
+}
+
+// upstreamClient returns the client for an upstream request of a rule. Clients are cheap,
+// the connections are pooled by their transport. jar keeps the cookies of the client
+// session, nil if there is none.
+func upstreamClient(rule ruleset.Rule, jar http.CookieJar) (*http.Client, error) {
+	settings := rule.Transport.WithDefaults(defaultTransport)
+	transport, err := transportFor(settings, ruleProxy(rule))
+	if err != nil {
+		return nil, err
+	}
+
+	// the Timeout of the rule is enforced by fetchSite with an upstreamTimeout, so it can end
+	// before a streamed body is read
+	return &http.Client{
+		Transport: transport,
+		Jar:       jar,
+		// redirects are followed by fetchSite, so that every hop gets the rule of its URL
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// ruleProxy returns the outbound proxy setting of a rule, UPSTREAM_PROXY if it sets none.
+func ruleProxy(rule ruleset.Rule) string {
+	if rule.Proxy != "" {
+		return rule.Proxy
+	}
+
+	return upstreamProxy
+}
+
+// transportFor returns the shared transport with the connection settings, that connects
+// through the outbound proxy setting.
+func transportFor(settings ruleset.Transport, proxy string) (*http.Transport, error) {
+	// the timeouts of the whole request and of streamed bodies are enforced by fetchSite
+	settings.Timeout, settings.StreamIdleTimeout, settings.StreamTimeout = 0, 0, 0
+	key := transportKey{settings: settings, proxy: proxy}
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if t, ok := transports[key]; ok {
+		return t, nil
+	}
+
+	dialer := &net.Dialer{Timeout: settings.DialTimeout, KeepAlive: 30 * time.Second}
+	t := &http.Transport{
+		TLSHandshakeTimeout:   settings.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: settings.ResponseHeaderTimeout,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   settings.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       settings.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     !settings.DisableHTTP2,
+	}
+	if settings.DisableHTTP2 {
+		// a non-nil empty map keeps the transport from upgrading to HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if err := outbound.Configure(t, dialer, proxy); err != nil {
+		return nil, err
+	}
+	transports[key] = t
+
+	return t, nil
+}
@@ -0,0 +1,120 @@
+// Package outbound routes the connections ladder makes to upstreams through HTTP and
+// SOCKS5 proxies.
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Direct is the proxy setting that connects to upstreams without a proxy.
+const Direct = "direct"
+
+// clientTimeout bounds every request of a Client, including reading its body.
+var clientTimeout = time.Minute
+
+// Parse parses a proxy setting: an http://, https://, socks5:// or socks5h:// URL, or direct.
+// It returns nil for direct and for an empty setting.
+func Parse(setting string) (*url.URL, error) {
+	if setting == "" || setting == Direct {
+		return nil, nil
+	}
+
+	u, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy '%s': %w", setting, err)
+	}
+
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy '%s', expected an http, https, socks5 or socks5h URL, or %s", setting, Direct)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy '%s', no host", setting)
+	}
+
+	return u, nil
+}
+
+// FromEnv returns the proxy setting of UPSTREAM_PROXY.
+func FromEnv() string {
+	return os.Getenv("UPSTREAM_PROXY")
+}
+
+// Configure routes the connections of a transport, dialed with dialer, through a proxy
+// setting. An empty setting uses the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables, like the default transport of net/http.
+//
+// HTTP and HTTPS proxies get a CONNECT request for HTTPS upstreams. socks5 resolves the
+// upstream host locally, socks5h leaves it to the proxy.
+func Configure(t *http.Transport, dialer *net.Dialer, setting string) error {
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+
+	if setting == "" {
+		t.Proxy = http.ProxyFromEnvironment
+		return nil
+	}
+
+	u, err := Parse(setting)
+	if err != nil || u == nil {
+		return err
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		t.Proxy = http.ProxyURL(u)
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+		if err != nil {
+			return err
+		}
+		dial := d.(proxy.ContextDialer).DialContext
+
+		if u.Scheme == "socks5h" {
+			t.DialContext = dial
+			return nil
+		}
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+
+			return dial(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+		}
+	}
+
+	return nil
+}
+
+// Client returns a client that connects through a proxy setting, for requests that are not
+// made by the proxy pipeline, such as ruleset fetches. Its requests time out after a minute,
+// so a stalled server cannot block a caller, like a ruleset reload, for good.
+func Client(setting string) (*http.Client, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if err := Configure(t, dialer, setting); err != nil {
+		return nil, err
+	}
+
+	return &http.Client{Transport: t, Timeout: clientTimeout}, nil
+}
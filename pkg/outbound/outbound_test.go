@@ -0,0 +1,143 @@
+package outbound
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	for _, setting := range []string{"", Direct} {
+		u, err := Parse(setting)
+		assert.NoError(t, err)
+		assert.Nil(t, u)
+	}
+
+	for _, setting := range []string{"http://proxy:3128", "https://proxy", "socks5://user:pw@proxy:1080", "socks5h://proxy:1080"} {
+		u, err := Parse(setting)
+		assert.NoError(t, err, setting)
+		assert.NotNil(t, u, setting)
+	}
+
+	for _, setting := range []string{"ftp://proxy", "proxy:3128", "socks5://", "tor"} {
+		_, err := Parse(setting)
+		assert.Error(t, err, setting)
+	}
+}
+
+// socksServer is a SOCKS5 proxy without authentication that records the address of every
+// CONNECT and connects to target instead.
+func socksServer(t *testing.T, target string, addrs chan<- string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				// greeting: version, methods
+				head := make([]byte, 2)
+				io.ReadFull(conn, head)
+				io.ReadFull(conn, make([]byte, head[1]))
+				conn.Write([]byte{5, 0})
+
+				// request: version, command, reserved, address type, address, port
+				req := make([]byte, 4)
+				io.ReadFull(conn, req)
+				var host string
+				switch req[3] {
+				case 1, 4:
+					ip := make([]byte, 4+12*(req[3]/4))
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 3:
+					n := make([]byte, 1)
+					io.ReadFull(conn, n)
+					name := make([]byte, n[0])
+					io.ReadFull(conn, name)
+					host = string(name)
+				}
+				port := make([]byte, 2)
+				io.ReadFull(conn, port)
+				addrs <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestConfigureSocks5(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	_, port, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+
+	addrs := make(chan string, 1)
+	proxy := socksServer(t, upstream.Listener.Addr().String(), addrs)
+
+	// socks5 resolves the host locally, socks5h sends it to the proxy
+	for scheme, resolved := range map[string]bool{"socks5": true, "socks5h": false} {
+		client, err := Client(scheme + "://" + proxy)
+		if !assert.NoError(t, err) {
+			continue
+		}
+
+		resp, err := client.Get("http://localhost:" + port + "/")
+		if !assert.NoError(t, err, scheme) {
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		assert.Equal(t, "ok", string(body))
+		host, _, _ := net.SplitHostPort(<-addrs)
+		assert.Equal(t, resolved, net.ParseIP(host) != nil, scheme)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer upstream.Close()
+	defer close(stalled)
+
+	defer func(timeout time.Duration) { clientTimeout = timeout }(clientTimeout)
+	clientTimeout = 100 * time.Millisecond
+
+	client, err := Client(Direct)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = client.Get(upstream.URL)
+	assert.ErrorContains(t, err, "Client.Timeout")
+}
@@ -0,0 +1,380 @@
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+
+	"ladder/pkg/outbound"
+
+	"github.com/andybalholm/cascadia"
+	"gopkg.in/yaml.v3"
+)
+
+// Rules are compiled while they are decoded, so a ruleset that loaded without
+// an error is guaranteed to contain only valid regexes and CSS selectors.
+// Invalid rules are rejected with the line they were declared on.
+
+// UnmarshalYAML decodes a Rule and compiles its path matchers.
+func (rule *Rule) UnmarshalYAML(node *yaml.Node) error {
+	type plain Rule
+	if err := node.Decode((*plain)(rule)); err != nil {
+		return err
+	}
+
+	if err := rule.compileMatchers(); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	// conditions are evaluated on the upstream response, after the request was sent
+	for _, r := range append(rule.URLMods.Domain, rule.URLMods.Path...) {
+		if len(r.When) > 0 {
+			return fmt.Errorf("line %d: urlMods do not support when", node.Line)
+		}
+	}
+	for _, h := range rule.RequestHeaders {
+		if len(h.When) > 0 {
+			return fmt.Errorf("line %d: requestHeaders do not support when", node.Line)
+		}
+	}
+
+	for _, name := range append(rule.HeaderPolicy.Allow, rule.HeaderPolicy.Deny...) {
+		if name != "*" && !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("line %d: invalid header name '%s' in headerPolicy", node.Line, name)
+		}
+	}
+
+	for _, method := range rule.Methods {
+		if !headerNameRegex.MatchString(method) {
+			return fmt.Errorf("line %d: invalid method '%s'", node.Line, method)
+		}
+	}
+
+	switch rule.Redirects {
+	case "", RedirectFollow, RedirectPass:
+	default:
+		return fmt.Errorf("line %d: invalid redirects '%s', expected %s or %s", node.Line, rule.Redirects, RedirectFollow, RedirectPass)
+	}
+
+	switch rule.Runtime {
+	case "", RuntimeOff, RuntimeShim, RuntimeServiceWorker:
+	default:
+		return fmt.Errorf("line %d: invalid runtime '%s', expected %s, %s or %s", node.Line, rule.Runtime, RuntimeOff, RuntimeShim, RuntimeServiceWorker)
+	}
+
+	if _, err := outbound.Parse(rule.Proxy); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	if rule.Cache.TTL < 0 {
+		return fmt.Errorf("line %d: cache ttl must not be negative", node.Line)
+	}
+
+	t := rule.Transport
+	if t.DialTimeout < 0 || t.TLSHandshakeTimeout < 0 || t.ResponseHeaderTimeout < 0 || t.Timeout < 0 ||
+		t.StreamIdleTimeout < 0 || t.StreamTimeout < 0 {
+		return fmt.Errorf("line %d: transport timeouts must not be negative", node.Line)
+	}
+	if t.MaxIdleConnsPerHost < 0 || t.MaxConnsPerHost < 0 {
+		return fmt.Errorf("line %d: transport connection limits must not be negative", node.Line)
+	}
+
+	return nil
+}
+
+// compileMatchers compiles the pathPatterns, urlRegex and excludePaths of a rule.
+// It does nothing if the rule is already compiled.
+func (rule *Rule) compileMatchers() error {
+	if len(rule.pathPatterns) == len(rule.PathPatterns) &&
+		len(rule.excludePaths) == len(rule.ExcludePaths) &&
+		(rule.urlRegex != nil) == (rule.URLRegex != "") {
+		return nil
+	}
+
+	rule.pathPatterns = make([]*regexp.Regexp, 0, len(rule.PathPatterns))
+	for _, pattern := range rule.PathPatterns {
+		re, err := compileGlob(pattern, false)
+		if err != nil {
+			return fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+		rule.pathPatterns = append(rule.pathPatterns, re)
+	}
+
+	rule.excludePaths = make([]*regexp.Regexp, 0, len(rule.ExcludePaths))
+	for _, pattern := range rule.ExcludePaths {
+		re, err := compileGlob(pattern, !strings.ContainsAny(pattern, "*?"))
+		if err != nil {
+			return fmt.Errorf("invalid exclude path '%s': %w", pattern, err)
+		}
+		rule.excludePaths = append(rule.excludePaths, re)
+	}
+
+	rule.urlRegex = nil
+	if rule.URLRegex != "" {
+		re, err := regexp.Compile(rule.URLRegex)
+		if err != nil {
+			return fmt.Errorf("invalid url regex '%s': %w", rule.URLRegex, err)
+		}
+		rule.urlRegex = re
+	}
+
+	return nil
+}
+
+// compile compiles everything of a rule that was built in code instead of decoded from YAML:
+// its path matchers, regexes, selectors and conditions. Slices are copied before an element
+// is compiled, so the rules the rule shares them with are not modified.
+func (rule *Rule) compile() error {
+	if err := rule.compileMatchers(); err != nil {
+		return err
+	}
+
+	var err error
+	if rule.When, _, err = rule.When.compile(); err != nil {
+		return err
+	}
+	if rule.RegexRules, err = compileEach(rule.RegexRules, Regex.compiled); err != nil {
+		return err
+	}
+	if rule.URLMods.Domain, err = compileEach(rule.URLMods.Domain, Regex.compiled); err != nil {
+		return err
+	}
+	if rule.URLMods.Path, err = compileEach(rule.URLMods.Path, Regex.compiled); err != nil {
+		return err
+	}
+	if rule.Injections, err = compileEach(rule.Injections, Injection.compiled); err != nil {
+		return err
+	}
+	rule.ResponseHeaders, err = compileEach(rule.ResponseHeaders, func(h HeaderRule) (HeaderRule, bool, error) {
+		when, changed, err := h.When.compile()
+		h.When = when
+		return h, changed, err
+	})
+
+	return err
+}
+
+// compileEach compiles the items, copying them if any needed compiling.
+func compileEach[T any](items []T, compiled func(T) (T, bool, error)) ([]T, error) {
+	var copied []T
+	for i := range items {
+		item, changed, err := compiled(items[i])
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			continue
+		}
+		if copied == nil {
+			copied = slices.Clone(items)
+		}
+		copied[i] = item
+	}
+
+	if copied == nil {
+		return items, nil
+	}
+
+	return copied, nil
+}
+
+// compileGlob compiles a path glob into a regex. `*` matches any characters except `/`,
+// `**` matches any characters including `/` and `?` matches a single character except `/`.
+// If prefix is set, the pattern also matches every path that starts with it.
+func compileGlob(pattern string, prefix bool) (*regexp.Regexp, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("pattern must start with /")
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			b.WriteString("[^/]*")
+		case pattern[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	if !prefix {
+		b.WriteString("$")
+	}
+
+	return regexp.Compile(b.String())
+}
+
+// UnmarshalYAML decodes a Regex and compiles its match pattern.
+func (r *Regex) UnmarshalYAML(node *yaml.Node) error {
+	type plain Regex
+	if err := node.Decode((*plain)(r)); err != nil {
+		return err
+	}
+
+	if err := r.compile(); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	return nil
+}
+
+// compile compiles the match pattern of a Regex.
+func (r *Regex) compile() error {
+	re, err := regexp.Compile(r.Match)
+	if err != nil {
+		return fmt.Errorf("invalid regex '%s': %w", r.Match, err)
+	}
+	r.re = re
+
+	return nil
+}
+
+// compiled returns the Regex with its pattern and conditions compiled, and whether any needed
+// compiling.
+func (r Regex) compiled() (Regex, bool, error) {
+	changed := r.re == nil
+	if changed {
+		if err := r.compile(); err != nil {
+			return r, false, err
+		}
+	}
+
+	when, whenChanged, err := r.When.compile()
+	if err != nil {
+		return r, false, err
+	}
+	r.When = when
+
+	return r, changed || whenChanged, nil
+}
+
+// Regexp returns the compiled match pattern, nil if the Regex was neither decoded from YAML
+// nor compiled by NewMatcher.
+func (r *Regex) Regexp() *regexp.Regexp {
+	return r.re
+}
+
+var headerNameRegex = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// UnmarshalYAML decodes a HeaderRule and checks the header name and operation.
+func (h *HeaderRule) UnmarshalYAML(node *yaml.Node) error {
+	type plain HeaderRule
+	if err := node.Decode((*plain)(h)); err != nil {
+		return err
+	}
+
+	if !headerNameRegex.MatchString(h.Name) {
+		return fmt.Errorf("line %d: invalid header name '%s'", node.Line, h.Name)
+	}
+
+	switch h.Op {
+	case "", HeaderSet, HeaderAppend, HeaderDelete:
+	default:
+		return fmt.Errorf("line %d: invalid header op '%s', expected set, append or delete", node.Line, h.Op)
+	}
+
+	return nil
+}
+
+// UnmarshalYAML decodes an Injection and compiles its position selector.
+func (i *Injection) UnmarshalYAML(node *yaml.Node) error {
+	type plain Injection
+	if err := node.Decode((*plain)(i)); err != nil {
+		return err
+	}
+
+	if err := i.compile(); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	i.line = node.Line
+
+	if i.Limit < 0 {
+		return fmt.Errorf("line %d: invalid limit %d", node.Line, i.Limit)
+	}
+
+	for name := range i.SetAttr {
+		if name == "" {
+			return fmt.Errorf("line %d: setAttr has an empty attribute name", node.Line)
+		}
+	}
+
+	empty := *i
+	empty.Position = ""
+	empty.Limit = 0
+	empty.When = nil
+	empty.selector = nil
+	empty.line = 0
+	if reflect.ValueOf(empty).IsZero() {
+		return fmt.Errorf("line %d: injection for '%s' has no operation", node.Line, i.Position)
+	}
+
+	return nil
+}
+
+// compile compiles the position selector of an Injection.
+func (i *Injection) compile() error {
+	sel, err := cascadia.Compile(i.Position)
+	if err != nil {
+		return fmt.Errorf("invalid selector '%s': %w", i.Position, err)
+	}
+	i.selector = sel
+
+	return nil
+}
+
+// compiled returns the Injection with its selector and conditions compiled, and whether any
+// needed compiling.
+func (i Injection) compiled() (Injection, bool, error) {
+	changed := i.selector == nil
+	if changed {
+		if err := i.compile(); err != nil {
+			return i, false, err
+		}
+	}
+
+	when, whenChanged, err := i.When.compile()
+	if err != nil {
+		return i, false, err
+	}
+	i.When = when
+
+	return i, changed || whenChanged, nil
+}
+
+// Selector returns the compiled position selector, nil if the Injection was neither decoded
+// from YAML nor compiled by NewMatcher.
+func (i *Injection) Selector() cascadia.Selector {
+	return i.selector
+}
+
+// UnmarshalYAML decodes a RuleTest and checks its URL and selectors.
+func (t *RuleTest) UnmarshalYAML(node *yaml.Node) error {
+	type plain RuleTest
+	if err := node.Decode((*plain)(t)); err != nil {
+		return err
+	}
+
+	if t.URL == "" {
+		return fmt.Errorf("line %d: test has no url", node.Line)
+	}
+	if t.HTML != "" && t.File != "" {
+		return fmt.Errorf("line %d: test has both html and file", node.Line)
+	}
+
+	for _, sel := range append(t.Expect.Present, t.Expect.Absent...) {
+		if _, err := cascadia.Compile(sel); err != nil {
+			return fmt.Errorf("line %d: invalid selector '%s': %w", node.Line, sel, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,295 @@
+package ruleset
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Condition restricts a rule, regex rule, injection or response header to some upstream
+// responses. All fields that are set must match.
+type Condition struct {
+	ContentType StringList        `yaml:"contentType,omitempty"` // media types, e.g. text/html or text/*
+	Status      StringList        `yaml:"status,omitempty"`      // status codes or ranges, e.g. 200, 2xx or 400-499
+	Headers     map[string]string `yaml:"headers,omitempty"`     // the header must be present, a non-empty value is a regex its value must match
+	MinSize     int               `yaml:"minSize,omitempty"`     // minimum body size in bytes
+	MaxSize     int               `yaml:"maxSize,omitempty"`     // maximum body size in bytes
+
+	status  [][2]int
+	headers map[string]*regexp.Regexp
+}
+
+// Conditions is the `when` of a rule or one of its parts. In YAML it is either a single
+// condition or a list of conditions. It matches if all of its conditions match.
+type Conditions []Condition
+
+// StringList is a list of strings that can also be written as a single string in YAML.
+type StringList []string
+
+// ResponseInfo describes the upstream response that conditions are evaluated against.
+type ResponseInfo struct {
+	StatusCode  int
+	Header      http.Header
+	ContentType string // the Content-Type header, or the sniffed content type if it is missing
+	Size        int    // the body size in bytes, -1 if it is unknown, like for a streamed body without Content-Length
+}
+
+var statusRegex = regexp.MustCompile(`^([1-5])xx$|^(\d{3})(?:-(\d{3}))?$`)
+
+// UnmarshalYAML decodes a single condition or a list of conditions.
+func (c *Conditions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		var cond Condition
+		if err := node.Decode(&cond); err != nil {
+			return err
+		}
+		*c = Conditions{cond}
+
+		return nil
+	}
+
+	var conds []Condition
+	if err := node.Decode(&conds); err != nil {
+		return err
+	}
+	*c = conds
+
+	return nil
+}
+
+// MarshalYAML writes a single condition as a mapping, so merged rulesets look like they were written.
+func (c Conditions) MarshalYAML() (any, error) {
+	if len(c) == 1 {
+		return c[0], nil
+	}
+
+	return []Condition(c), nil
+}
+
+// UnmarshalYAML decodes a single string or a list of strings.
+func (l *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = StringList{node.Value}
+		return nil
+	}
+
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+
+	return nil
+}
+
+// UnmarshalYAML decodes a Condition and compiles its status ranges and header regexes.
+func (c *Condition) UnmarshalYAML(node *yaml.Node) error {
+	type plain Condition
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+
+	if err := c.compile(); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+
+	return nil
+}
+
+// compile parses the status ranges and compiles the header regexes of a condition.
+func (c *Condition) compile() error {
+	c.status = make([][2]int, 0, len(c.Status))
+	for _, s := range c.Status {
+		m := statusRegex.FindStringSubmatch(strings.TrimSpace(s))
+		if m == nil {
+			return fmt.Errorf("invalid status '%s', expected a code, a class like 4xx or a range like 400-499", s)
+		}
+
+		var from, to int
+		switch {
+		case m[1] != "":
+			from, _ = strconv.Atoi(m[1] + "00")
+			to = from + 99
+		case m[3] != "":
+			from, _ = strconv.Atoi(m[2])
+			to, _ = strconv.Atoi(m[3])
+		default:
+			from, _ = strconv.Atoi(m[2])
+			to = from
+		}
+
+		if from > to {
+			return fmt.Errorf("invalid status range '%s'", s)
+		}
+
+		c.status = append(c.status, [2]int{from, to})
+	}
+
+	for _, ct := range c.ContentType {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("invalid content type '%s': %w", ct, err)
+		}
+	}
+
+	c.headers = make(map[string]*regexp.Regexp, len(c.Headers))
+	for name, value := range c.Headers {
+		if !headerNameRegex.MatchString(name) {
+			return fmt.Errorf("invalid header name '%s'", name)
+		}
+		if value == "" {
+			c.headers[name] = nil
+			continue
+		}
+
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return fmt.Errorf("invalid regex '%s' for header '%s': %w", value, name, err)
+		}
+		c.headers[name] = re
+	}
+
+	if c.MaxSize != 0 && c.MaxSize < c.MinSize {
+		return fmt.Errorf("maxSize %d is less than minSize %d", c.MaxSize, c.MinSize)
+	}
+
+	return nil
+}
+
+// compiled reports whether the status ranges and header regexes of the condition are compiled.
+func (c *Condition) compiled() bool {
+	return c.status != nil && c.headers != nil
+}
+
+// compile returns the conditions with those built in code instead of decoded from YAML
+// compiled, copied if any needed compiling, and whether any did.
+func (c Conditions) compile() (Conditions, bool, error) {
+	var copied Conditions
+	for i := range c {
+		if c[i].compiled() {
+			continue
+		}
+		if copied == nil {
+			copied = slices.Clone(c)
+		}
+		if err := copied[i].compile(); err != nil {
+			return c, false, fmt.Errorf("invalid condition: %w", err)
+		}
+	}
+
+	if copied == nil {
+		return c, false, nil
+	}
+
+	return copied, true, nil
+}
+
+// Match reports whether all conditions match the response. Empty Conditions always match.
+func (c Conditions) Match(r ResponseInfo) bool {
+	for i := range c {
+		if !c[i].Match(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HasContentType reports whether any of the conditions restricts the content type.
+func (c Conditions) HasContentType() bool {
+	for _, cond := range c {
+		if len(cond.ContentType) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchContentType reports whether the content type conditions match a Content-Type header,
+// ignoring all other conditions. It is used to decide whether a response must be buffered
+// before the rest of it is known.
+func (c Conditions) MatchContentType(contentType string) bool {
+	for _, cond := range c {
+		if len(cond.ContentType) > 0 && !matchContentType(cond.ContentType, contentType) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Match reports whether the condition matches the response. A condition that was neither
+// decoded from YAML nor compiled by NewMatcher never matches.
+func (c *Condition) Match(r ResponseInfo) bool {
+	if !c.compiled() {
+		return false
+	}
+
+	if len(c.ContentType) > 0 && !matchContentType(c.ContentType, r.ContentType) {
+		return false
+	}
+
+	if len(c.status) > 0 {
+		ok := false
+		for _, s := range c.status {
+			if r.StatusCode >= s[0] && r.StatusCode <= s[1] {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	for name, re := range c.headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return false
+		}
+		if re != nil && !re.MatchString(strings.Join(values, ", ")) {
+			return false
+		}
+	}
+
+	// a body of unknown size matches no size condition
+	if c.MinSize != 0 || c.MaxSize != 0 {
+		if r.Size < 0 || r.Size < c.MinSize || (c.MaxSize != 0 && r.Size > c.MaxSize) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchContentType reports whether a Content-Type header matches any of the media types.
+// A pattern like text/* matches every subtype.
+func matchContentType(patterns []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+			continue
+		}
+
+		if pattern == mediaType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,179 @@
+package ruleset
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionsMatch(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- domain: example.com
+  when:
+    contentType: [text/html, application/*+json, image/*]
+    status: [2xx, 404, 500-503]
+    headers:
+      X-Cache: ""
+      Server: ^nginx
+    minSize: 10
+    maxSize: 100
+`)
+	assert.NoError(t, err)
+
+	when := rs[0].When
+	ok := ResponseInfo{
+		StatusCode:  200,
+		Header:      http.Header{"X-Cache": {"HIT"}, "Server": {"nginx/1.25"}},
+		ContentType: "text/html; charset=utf-8",
+		Size:        50,
+	}
+	assert.True(t, when.Match(ok))
+
+	testCases := []struct {
+		name   string
+		modify func(r *ResponseInfo)
+	}{
+		{"content type", func(r *ResponseInfo) { r.ContentType = "application/json" }},
+		{"status", func(r *ResponseInfo) { r.StatusCode = 302 }},
+		{"missing header", func(r *ResponseInfo) { r.Header = http.Header{"Server": {"nginx"}} }},
+		{"header value", func(r *ResponseInfo) { r.Header = http.Header{"X-Cache": {"HIT"}, "Server": {"apache"}} }},
+		{"too small", func(r *ResponseInfo) { r.Size = 5 }},
+		{"too large", func(r *ResponseInfo) { r.Size = 500 }},
+		{"unknown size", func(r *ResponseInfo) { r.Size = -1 }},
+	}
+
+	for _, tc := range testCases {
+		r := ok
+		tc.modify(&r)
+		assert.False(t, when.Match(r), tc.name)
+	}
+
+	for _, status := range []int{204, 404, 502} {
+		r := ok
+		r.StatusCode = status
+		assert.True(t, when.Match(r), status)
+	}
+
+	r := ok
+	r.ContentType = "image/png"
+	assert.True(t, when.Match(r))
+
+	// without size conditions, the size does not matter
+	rs, err = loadRuleFromString(`
+- domain: example.com
+  when:
+    status: 200
+`)
+	assert.NoError(t, err)
+	r.Size = -1
+	assert.True(t, rs[0].When.Match(r))
+
+	// a list of conditions must all match
+	rs, err = loadRuleFromString(`
+- domain: example.com
+  when:
+    - status: 200
+    - contentType: text/html
+`)
+	assert.NoError(t, err)
+	assert.Len(t, rs[0].When, 2)
+	assert.True(t, rs[0].When.Match(ok))
+	r.StatusCode = 404
+	assert.False(t, rs[0].When.Match(r))
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  when:
+    status: 600-200`)
+	assert.ErrorContains(t, err, "invalid status range '600-200'")
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  requestHeaders:
+    - name: Accept
+      value: text/html
+      when:
+        status: 200`)
+	assert.ErrorContains(t, err, "requestHeaders do not support when")
+}
+
+func TestMergePushesDownWhen(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- domain: example.com
+  when:
+    contentType: application/json
+  regexRules:
+    - match: foo
+      replace: bar
+      when:
+        status: 200
+  injections:
+    - position: body
+      remove: true
+- domain: example.com
+  paths:
+    - /article
+  regexRules:
+    - match: baz
+      replace: qux
+`)
+	assert.NoError(t, err)
+
+	merged := Merge(rs[1], rs[0])
+	assert.Empty(t, merged.When)
+
+	if assert.Len(t, merged.RegexRules, 2) {
+		assert.Len(t, merged.RegexRules[0].When, 2)
+		assert.Equal(t, StringList{"application/json"}, merged.RegexRules[0].When[0].ContentType)
+		assert.Empty(t, merged.RegexRules[1].When)
+	}
+	assert.Len(t, merged.Injections[0].When, 1)
+
+	// the rules themselves are unchanged
+	assert.Len(t, rs[0].RegexRules[0].When, 1)
+	assert.Len(t, rs[0].When, 1)
+
+	// a single rule is pushed down too, so it behaves the same whatever else matches
+	single := Merge(rs[0])
+	assert.Empty(t, single.When)
+	assert.Len(t, single.RegexRules[0].When, 2)
+}
+
+func TestNewMatcherCompilesRules(t *testing.T) {
+	rs := RuleSet{{
+		Domain: "example.com",
+		When:   Conditions{{Status: StringList{"2xx"}}},
+		RegexRules: []Regex{
+			{Match: "a", Replace: "b", When: Conditions{{Headers: map[string]string{"X-Test": "^y"}}}},
+		},
+		Injections: []Injection{{Position: "body", Remove: true}},
+	}}
+	rs[0].URLMods.Path = []Regex{{Match: "^/amp/", Replace: "/"}}
+
+	m, err := NewMatcher(rs)
+	assert.NoError(t, err)
+
+	rule, ok := m.Match("example.com", "/")
+	assert.True(t, ok)
+	r := ResponseInfo{StatusCode: 200, Header: http.Header{"X-Test": {"yes"}}}
+	assert.True(t, rule.RegexRules[0].When.Match(r))
+	assert.NotNil(t, rule.RegexRules[0].Regexp())
+	assert.NotNil(t, rule.URLMods.Path[0].Regexp())
+	assert.NotNil(t, rule.Injections[0].Selector())
+
+	// the rules themselves are not compiled, and uncompiled conditions never match
+	assert.Nil(t, rs[0].RegexRules[0].Regexp())
+	assert.False(t, rs[0].RegexRules[0].When.Match(r))
+
+	// invalid rules built in code are reported instead of panicking during requests
+	for _, rule := range []Rule{
+		{Domain: "example.com", RegexRules: []Regex{{Match: "[a"}}},
+		{Domain: "example.com", Injections: []Injection{{Position: "div[", Remove: true}}},
+		{Domain: "example.com", When: Conditions{{Status: StringList{"not a status"}}}},
+		{Domain: "example.com", PathPatterns: []string{"article/*"}},
+	} {
+		_, err := NewMatcher(RuleSet{rule})
+		assert.ErrorContains(t, err, "rule for 'example.com': invalid")
+	}
+}
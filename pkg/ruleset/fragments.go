@@ -0,0 +1,141 @@
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fragments are named, reusable parts of rules. A ruleset entry with `fragment: <name>`
+// instead of domains declares a fragment, and rules reference it with `extends: [<name>]`.
+// Fragments may extend other fragments.
+//
+// A rule extending several fragments is merged like rules matching the same request
+// (see Merge): later fragments override earlier ones, and the rule overrides all of its
+// fragments. regexRules, injections and urlMods of the fragments run before the rule's own.
+
+// Resolve expands the `extends` of every rule with the named fragments and inlines
+// included files, so the returned RuleSet only contains self-contained rules.
+// Fragments are removed from the returned RuleSet.
+// Rules that cannot be resolved are skipped and reported in the returned error.
+func (rs RuleSet) Resolve() (RuleSet, error) {
+	var errs []error
+
+	fragments := map[string]Rule{}
+	for _, rule := range rs {
+		if rule.Fragment == "" {
+			continue
+		}
+		if _, ok := fragments[rule.Fragment]; ok {
+			errs = append(errs, fmt.Errorf("%s: duplicate fragment '%s'", rule.source, rule.Fragment))
+			continue
+		}
+		fragments[rule.Fragment] = rule
+	}
+
+	resolved := make(RuleSet, 0, len(rs))
+
+	for _, rule := range rs {
+		if rule.Fragment != "" {
+			continue
+		}
+
+		r, err := resolveRule(rule, fragments, nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: rule for '%s': %w", rule.source, strings.Join(rule.AllDomains(), ", "), err))
+			continue
+		}
+
+		resolved = append(resolved, r)
+	}
+
+	return resolved, errors.Join(errs...)
+}
+
+// resolveRule merges a rule with the fragments it extends. stack holds the fragments
+// currently being resolved, to detect cycles.
+func resolveRule(rule Rule, fragments map[string]Rule, stack []string) (Rule, error) {
+	chain := make([]Rule, 0, len(rule.Extends)+1)
+	chain = append(chain, rule)
+
+	// most specific first: the rule, then its fragments from last to first
+	for i := len(rule.Extends) - 1; i >= 0; i-- {
+		name := rule.Extends[i]
+
+		for _, s := range stack {
+			if s == name {
+				return Rule{}, fmt.Errorf("fragment cycle %s -> %s", strings.Join(stack, " -> "), name)
+			}
+		}
+
+		fragment, ok := fragments[name]
+		if !ok {
+			return Rule{}, fmt.Errorf("unknown fragment '%s'", name)
+		}
+
+		resolved, err := resolveRule(fragment, fragments, append(stack, name))
+		if err != nil {
+			return Rule{}, err
+		}
+
+		chain = append(chain, resolved)
+	}
+
+	merged := Merge(chain...)
+	merged.Extends = nil
+
+	// Merge shares the injections of single rules, copy before inlining
+	merged.Injections = append([]Injection(nil), merged.Injections...)
+	for i := range merged.Injections {
+		merged.Injections[i].inline()
+	}
+
+	return merged, nil
+}
+
+// loadIncludes reads the files included by injections, relative to dir.
+func (rs RuleSet) loadIncludes(dir string) error {
+	for i := range rs {
+		for j := range rs[i].Injections {
+			injection := &rs[i].Injections[j]
+			if injection.Include == "" {
+				continue
+			}
+
+			content, err := os.ReadFile(filepath.Join(dir, injection.Include))
+			if err != nil {
+				return fmt.Errorf("line %d: failed to read include: %w", injection.line, err)
+			}
+
+			injection.included = wrapInclude(injection.Include, string(content))
+		}
+	}
+
+	return nil
+}
+
+// wrapInclude wraps the content of an included file in a tag matching its extension.
+// .js files become a <script>, .css files a <style>, anything else is included as HTML.
+func wrapInclude(name string, content string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".js":
+		return "<script>\n" + content + "</script>\n"
+	case ".css":
+		return "<style>\n" + content + "</style>\n"
+	default:
+		return content
+	}
+}
+
+// inline appends the content of the included file to the injection and drops the reference.
+func (i *Injection) inline() {
+	if i.Include == "" {
+		return
+	}
+
+	i.Append += i.included
+	i.Include = ""
+	i.included = ""
+}
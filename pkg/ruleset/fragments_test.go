@@ -0,0 +1,114 @@
+package ruleset
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveFragments(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- fragment: base
+  headers:
+    referer: base
+    cookie: base
+  injections:
+    - position: head
+      append: <base/>
+- fragment: override
+  extends: [base]
+  headers:
+    referer: override
+- domain: example.com
+  extends: [base, override]
+  headers:
+    cookie: rule
+  injections:
+    - position: body
+      append: <rule/>
+`)
+	assert.NoError(t, err)
+
+	resolved, err := rs.Resolve()
+	assert.NoError(t, err)
+	assert.Len(t, resolved, 1)
+
+	rule := resolved[0]
+	assert.Equal(t, "override", rule.Headers.Referer)
+	assert.Equal(t, "rule", rule.Headers.Cookie)
+	assert.Empty(t, rule.Extends)
+
+	// fragments run before the rule's own injections
+	if assert.Len(t, rule.Injections, 3) {
+		assert.Equal(t, "<base/>", rule.Injections[0].Append)
+		assert.Equal(t, "<rule/>", rule.Injections[2].Append)
+	}
+}
+
+func TestResolveFragmentErrors(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- fragment: a
+  extends: [b]
+- fragment: b
+  extends: [a]
+- domain: cycle.com
+  extends: [a]
+- domain: unknown.com
+  extends: [missing]
+- domain: ok.com
+  headers:
+    referer: ok
+`)
+	assert.NoError(t, err)
+
+	resolved, err := rs.Resolve()
+	assert.ErrorContains(t, err, "fragment cycle a -> b -> a")
+	assert.ErrorContains(t, err, "unknown fragment 'missing'")
+
+	// rules that cannot be resolved are skipped
+	assert.Len(t, resolved, 1)
+	assert.Equal(t, "ok.com", resolved[0].Domain)
+}
+
+func TestResolveIncludes(t *testing.T) {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"rules.yaml": `
+- domain: example.com
+  injections:
+    - position: head
+      include: script.js
+    - position: head
+      include: style.css
+    - position: body
+      include: banner.html
+`,
+		"script.js":   "alert(1);\n",
+		"style.css":   "body {}\n",
+		"banner.html": "<div>banner</div>",
+	}
+	for name, content := range files {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	rs, err := NewRuleset(dir)
+	assert.NoError(t, err)
+	if !assert.Len(t, rs, 1) || !assert.Len(t, rs[0].Injections, 3) {
+		return
+	}
+
+	injections := rs[0].Injections
+	assert.Equal(t, "<script>\nalert(1);\n</script>\n", injections[0].Append)
+	assert.Equal(t, "<style>\nbody {}\n</style>\n", injections[1].Append)
+	assert.Equal(t, "<div>banner</div>", injections[2].Append)
+	assert.Empty(t, injections[0].Include)
+
+	// missing include files fail the load
+	assert.NoError(t, os.Remove(filepath.Join(dir, "script.js")))
+	var missing RuleSet
+	err = missing.loadRulesFromLocalFile(filepath.Join(dir, "rules.yaml"))
+	assert.ErrorContains(t, err, "line 4: failed to read include")
+}
@@ -0,0 +1,505 @@
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Severity of a lint Diagnostic.
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a problem found by Lint, pointing to the file and line it was found on.
+type Diagnostic struct {
+	File     string
+	Line     int
+	Severity Severity
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", d.File, d.Line, d.Severity, d.Message)
+}
+
+// lintedRule is a rule that decoded successfully, together with where it was declared.
+type lintedRule struct {
+	rule Rule
+	file string
+	line int
+}
+
+var (
+	lineErrRegex  = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+	domainRegex   = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+	ruleFieldType = reflect.TypeOf(Rule{})
+)
+
+// Lint checks the local ruleset files and directories in rulePaths, separated by semicolons.
+// Unlike loading a ruleset, linting does not stop at the first problem and also reports
+// unknown fields, which are silently ignored when the rules are loaded, as well as
+// empty rules, rules for the same domain that are equally specific, unknown fragments and
+// missing include files.
+// The returned error is only set if a path cannot be read.
+func Lint(rulePaths string) ([]Diagnostic, error) {
+	var diags []Diagnostic
+	var rules []lintedRule
+
+	for _, rulePath := range strings.Split(rulePaths, ";") {
+		rulePath = strings.Trim(rulePath, " ")
+		if remoteRegex.MatchString(rulePath) {
+			return nil, fmt.Errorf("lint only supports local rulesets, got '%s'", rulePath)
+		}
+
+		err := filepath.WalkDir(rulePath, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !yamlRegex.MatchString(path) {
+				return nil
+			}
+
+			yamlFile, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			fileRules, fileDiags := lintFile(path, yamlFile)
+			rules = append(rules, fileRules...)
+			diags = append(diags, fileDiags...)
+
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	diags = append(diags, lintDomains(rules)...)
+	diags = append(diags, lintFragments(rules)...)
+
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Line < diags[j].Line
+	})
+
+	return diags, nil
+}
+
+// lintFile checks a single YAML file and returns the rules that could be decoded.
+func lintFile(path string, yamlFile []byte) ([]lintedRule, []Diagnostic) {
+	var rules []lintedRule
+	var diags []Diagnostic
+
+	report := func(line int, severity Severity, format string, args ...any) {
+		diags = append(diags, Diagnostic{File: path, Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(yamlFile, &doc); err != nil {
+		line, msg := splitLineErr(err)
+		report(line, SeverityError, "%s", msg)
+
+		return nil, diags
+	}
+
+	if len(doc.Content) == 0 {
+		report(1, SeverityWarning, "file contains no rules")
+		return nil, diags
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.SequenceNode {
+		report(root.Line, SeverityError, "ruleset must be a list of rules")
+		return nil, diags
+	}
+
+	for _, node := range root.Content {
+		for _, d := range checkKnownFields(node, ruleFieldType, "") {
+			report(d.Line, SeverityError, "%s", d.Message)
+		}
+
+		// decoding stops at the first invalid entry, so each is checked on its own, and the
+		// rest of a rule with invalid entries is decoded without them
+		var rule Rule
+		errs := lintEntries(node)
+		var err error
+		if len(errs) == 0 {
+			err = node.Decode(&rule)
+		} else {
+			err = withoutEntries(node).Decode(&rule)
+		}
+		if err != nil {
+			errs = append(errs, unwrapErrors(err)...)
+		}
+
+		if len(errs) > 0 {
+			for _, e := range errs {
+				line, msg := splitLineErr(e)
+				if line == 0 {
+					line = node.Line
+				}
+				report(line, SeverityError, "%s", msg)
+			}
+
+			// it is still declared for the checks across rules
+			rules = append(rules, lintedRule{rule: rule, file: path, line: node.Line})
+
+			continue
+		}
+
+		for _, injection := range rule.Injections {
+			if injection.Include == "" {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(path), injection.Include)); err != nil {
+				report(injection.line, SeverityError, "include '%s' not found", injection.Include)
+			}
+		}
+
+		domains := rule.AllDomains()
+
+		if rule.Fragment != "" {
+			if len(domains) > 0 {
+				report(node.Line, SeverityError, "fragment '%s' must not have domains", rule.Fragment)
+			}
+
+			rules = append(rules, lintedRule{rule: rule, file: path, line: node.Line})
+
+			continue
+		}
+
+		if len(domains) == 0 {
+			report(node.Line, SeverityError, "rule has no domain")
+		}
+
+		for _, domain := range domains {
+			if !domainRegex.MatchString(strings.ToLower(domain)) {
+				report(node.Line, SeverityError, "invalid domain '%s'", domain)
+			}
+		}
+
+		if rule.isEmpty() {
+			report(node.Line, SeverityWarning, "rule for '%s' does not modify anything", strings.Join(domains, ", "))
+		}
+
+		rules = append(rules, lintedRule{rule: rule, file: path, line: node.Line})
+	}
+
+	return rules, diags
+}
+
+// ruleEntries are the paths of the lists in a rule whose entries lintEntries checks separately.
+var ruleEntries = map[string]func(*yaml.Node) error{
+	"regexRules":     func(n *yaml.Node) error { return n.Decode(&Regex{}) },
+	"urlMods.domain": func(n *yaml.Node) error { return n.Decode(&Regex{}) },
+	"urlMods.path":   func(n *yaml.Node) error { return n.Decode(&Regex{}) },
+	"injections":     func(n *yaml.Node) error { return n.Decode(&Injection{}) },
+}
+
+// lintEntries decodes every entry of the ruleEntries of a rule node on its own and returns
+// the errors of all of them.
+func lintEntries(node *yaml.Node) []error {
+	var errs []error
+
+	for path, decode := range ruleEntries {
+		list := lookupNode(node, path)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		for _, entry := range list.Content {
+			if err := decode(entry); err != nil {
+				errs = append(errs, unwrapErrors(err)...)
+			}
+		}
+	}
+
+	// ruleEntries is a map, the errors are reported in the order of the file
+	sort.SliceStable(errs, func(i, j int) bool {
+		li, _ := splitLineErr(errs[i])
+		lj, _ := splitLineErr(errs[j])
+		return li < lj
+	})
+
+	return errs
+}
+
+// withoutEntries returns a copy of a rule node without its ruleEntries.
+func withoutEntries(node *yaml.Node) *yaml.Node {
+	return removeKeys(node, "", func(path string) bool {
+		_, ok := ruleEntries[path]
+		return ok
+	})
+}
+
+// removeKeys returns a copy of a mapping node without the keys whose dotted path, prefixed
+// with prefix, remove reports. Nested mappings are copied as well.
+func removeKeys(node *yaml.Node, prefix string, remove func(string) bool) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return node
+	}
+
+	copied := *node
+	copied.Content = nil
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		path := prefix + key.Value
+		if remove(path) {
+			continue
+		}
+		copied.Content = append(copied.Content, key, removeKeys(value, path+".", remove))
+	}
+
+	return &copied
+}
+
+// lookupNode returns the value of a dotted path of keys in a mapping node, or nil.
+func lookupNode(node *yaml.Node, path string) *yaml.Node {
+	for _, key := range strings.Split(path, ".") {
+		if node.Kind != yaml.MappingNode {
+			return nil
+		}
+
+		var value *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				value = node.Content[i+1]
+				break
+			}
+		}
+		if value == nil {
+			return nil
+		}
+		node = value
+	}
+
+	return node
+}
+
+// checkKnownFields walks a YAML node and reports every mapping key that has no matching field in t.
+func checkKnownFields(node *yaml.Node, t reflect.Type, path string) []Diagnostic {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var diags []Diagnostic
+
+	switch {
+	case node.Kind == yaml.SequenceNode && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array):
+		for _, child := range node.Content {
+			diags = append(diags, checkKnownFields(child, t.Elem(), path)...)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Slice:
+		// a single element written in place of a list, see Conditions
+		diags = append(diags, checkKnownFields(node, t.Elem(), path)...)
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 1; i < len(node.Content); i += 2 {
+			diags = append(diags, checkKnownFields(node.Content[i], t.Elem(), path)...)
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := yamlFields(t)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			field, ok := fields[key.Value]
+			if !ok {
+				diags = append(diags, Diagnostic{Line: key.Line, Message: fmt.Sprintf("unknown field '%s%s'", path, key.Value)})
+				continue
+			}
+
+			diags = append(diags, checkKnownFields(value, field.Type, path+key.Value+".")...)
+		}
+	}
+
+	return diags
+}
+
+// yamlFields maps the YAML names of the exported fields of a struct to the fields.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		fields[name] = field
+	}
+
+	return fields
+}
+
+// lintDomains reports rules for the same domain that cannot be told apart: they have the same
+// path matchers and priority, so neither is more specific than the other. Other rules for the
+// same domain, or for a parent domain, are merged by specificity (see Merge).
+func lintDomains(rules []lintedRule) []Diagnostic {
+	type declaration struct {
+		domain   string
+		matchers string
+		rule     lintedRule
+	}
+
+	var decls []declaration
+	byDomain := map[string][]declaration{}
+
+	for _, r := range rules {
+		for _, domain := range r.rule.AllDomains() {
+			d := declaration{
+				domain:   strings.TrimSuffix(strings.ToLower(domain), "."),
+				matchers: r.rule.matcherKey(),
+				rule:     r,
+			}
+			decls = append(decls, d)
+			byDomain[d.domain] = append(byDomain[d.domain], d)
+		}
+	}
+
+	var diags []Diagnostic
+
+	for _, d := range decls {
+		for _, other := range byDomain[d.domain] {
+			if other.rule.file == d.rule.file && other.rule.line == d.rule.line {
+				break
+			}
+			if other.matchers != d.matchers {
+				continue
+			}
+
+			diags = append(diags, Diagnostic{
+				File:     d.rule.file,
+				Line:     d.rule.line,
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("duplicate domain '%s', also declared at %s:%d", d.domain, other.rule.file, other.rule.line),
+			})
+
+			break
+		}
+	}
+
+	return diags
+}
+
+// lintFragments reports duplicate fragment names and references to unknown fragments.
+func lintFragments(rules []lintedRule) []Diagnostic {
+	var diags []Diagnostic
+
+	fragments := map[string]lintedRule{}
+	for _, r := range rules {
+		if r.rule.Fragment == "" {
+			continue
+		}
+
+		if other, ok := fragments[r.rule.Fragment]; ok {
+			diags = append(diags, Diagnostic{
+				File:     r.file,
+				Line:     r.line,
+				Severity: SeverityError,
+				Message:  fmt.Sprintf("duplicate fragment '%s', also declared at %s:%d", r.rule.Fragment, other.file, other.line),
+			})
+
+			continue
+		}
+
+		fragments[r.rule.Fragment] = r
+	}
+
+	for _, r := range rules {
+		for _, name := range r.rule.Extends {
+			if _, ok := fragments[name]; !ok {
+				diags = append(diags, Diagnostic{
+					File:     r.file,
+					Line:     r.line,
+					Severity: SeverityError,
+					Message:  fmt.Sprintf("unknown fragment '%s'", name),
+				})
+			}
+		}
+	}
+
+	return diags
+}
+
+// matcherKey describes what selects a rule for a request on one of its domains: its path
+// matchers and its priority. Rules with the same key are equally specific.
+func (rule Rule) matcherKey() string {
+	sorted := func(list []string) []string {
+		return slices.Sorted(slices.Values(list))
+	}
+
+	return fmt.Sprintf("%q %q %q %q %d", sorted(rule.Paths), sorted(rule.PathPatterns), rule.URLRegex, sorted(rule.ExcludePaths), rule.Priority)
+}
+
+// isEmpty reports whether a rule only selects domains and paths, without modifying anything.
+func (rule Rule) isEmpty() bool {
+	rule.Domain = ""
+	rule.Domains = nil
+	rule.Paths = nil
+	rule.PathPatterns = nil
+	rule.URLRegex = ""
+	rule.ExcludePaths = nil
+	rule.When = nil
+	rule.Tests = nil
+	rule.source = ""
+	rule.pathPatterns = nil
+	rule.urlRegex = nil
+	rule.excludePaths = nil
+
+	return reflect.ValueOf(rule).IsZero()
+}
+
+// splitLineErr extracts the line number from a YAML error message.
+// It returns line 0 if the message does not contain one.
+func splitLineErr(err error) (int, string) {
+	msg := err.Error()
+
+	m := lineErrRegex.FindStringSubmatch(msg)
+	if m == nil {
+		return 0, strings.TrimPrefix(msg, "yaml: ")
+	}
+
+	line, _ := strconv.Atoi(m[1])
+
+	return line, m[2]
+}
+
+// unwrapErrors splits a yaml.TypeError into one error per problem.
+func unwrapErrors(err error) []error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return []error{err}
+	}
+
+	errs := make([]error, 0, len(typeErr.Errors))
+	for _, e := range typeErr.Errors {
+		errs = append(errs, errors.New(e))
+	}
+
+	return errs
+}
@@ -0,0 +1,78 @@
+package ruleset
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint(t *testing.T) {
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "a.yaml"), []byte(`- domain: example.com
+  headers:
+    ueser-agent: Googlebot
+  regexRules:
+    - match: "[incomplete"
+      replace: ""
+    - match: "(unclosed"
+      replace: ""
+  injections:
+    - position: div[[
+      remove: true
+- domains:
+  - www.example.org
+  injections:
+    - position: body
+      appendd: "<p></p>"
+      remove: true
+- domain: empty.com
+- headers:
+    referer: none
+`), 0o644)
+
+	os.WriteFile(filepath.Join(dir, "b.yaml"), []byte(`- domain: example.com
+  googleCache: true
+- domain: example.org
+  googleCache: true
+- domain: Example.org
+  useFlareSolverr: true
+- domain: example.org
+  pathPatterns:
+    - /news/*
+  priority: 10
+  final: true
+  googleCache: true
+- domain: example.org
+  paths:
+    - /news/
+  googleCache: true
+`), 0o644)
+
+	diags, err := Lint(dir)
+	assert.NoError(t, err)
+
+	var messages []string
+	for _, d := range diags {
+		messages = append(messages, d.String())
+	}
+
+	a := filepath.Join(dir, "a.yaml")
+	b := filepath.Join(dir, "b.yaml")
+
+	assert.Contains(t, messages, a+":3: error: unknown field 'headers.ueser-agent'")
+	assert.Contains(t, messages, a+":5: error: invalid regex '[incomplete': error parsing regexp: missing closing ]: `[incomplete`")
+	// every invalid entry of a rule is reported
+	assert.Contains(t, messages, a+":7: error: invalid regex '(unclosed': error parsing regexp: missing closing ): `(unclosed`")
+	assert.Contains(t, messages, a+":10: error: invalid selector 'div[[': expected identifier, found [ instead")
+	assert.Contains(t, messages, a+":16: error: unknown field 'injections.appendd'")
+	assert.Contains(t, messages, a+":18: warning: rule for 'empty.com' does not modify anything")
+	assert.Contains(t, messages, a+":19: error: rule has no domain")
+	// a rule with invalid entries still takes part in the duplicate checks
+	assert.Contains(t, messages, b+":1: error: duplicate domain 'example.com', also declared at "+a+":1")
+	assert.Contains(t, messages, b+":5: error: duplicate domain 'example.org', also declared at "+b+":3")
+	// rules that differ in their path matchers or priority are layered, not duplicates
+	assert.Len(t, messages, 9)
+}
@@ -0,0 +1,261 @@
+package ruleset
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Matcher selects the rule for a request through a label-aware domain suffix index.
+// A rule for `example.com` applies to `example.com` and all of its subdomains,
+// but never to `evil-example.com`. Lookups only walk the labels of the host,
+// so their cost does not grow with the number of rules.
+type Matcher struct {
+	rules   RuleSet
+	root    *domainNode
+	domains []string
+}
+
+// domainNode is a node in the domain trie. The trie is keyed by domain labels
+// from right to left, so `www.example.com` is stored under com -> example -> www.
+type domainNode struct {
+	children map[string]*domainNode
+	rules    []int
+}
+
+// NewMatcher indexes the domains of every rule in the RuleSet. Rules decoded from YAML are
+// already compiled, rules built in code are compiled here, once, so requests only read them.
+// The RuleSet itself is not modified. An error is returned if a rule fails to compile.
+func NewMatcher(rs RuleSet) (*Matcher, error) {
+	m := &Matcher{
+		rules: slices.Clone(rs),
+		root:  &domainNode{},
+	}
+
+	for i := range m.rules {
+		if err := m.rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule for '%s': %w", strings.Join(m.rules[i].AllDomains(), ", "), err)
+		}
+
+		for _, domain := range m.rules[i].AllDomains() {
+			m.insert(domain, i)
+		}
+	}
+
+	m.domains = m.rules.Domains()
+
+	return m, nil
+}
+
+func (m *Matcher) insert(domain string, rule int) {
+	node := m.root
+
+	labels := domainLabels(domain)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = map[string]*domainNode{}
+			}
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	node.rules = append(node.rules, rule)
+}
+
+// RuleSet returns the rules the Matcher was built from.
+func (m *Matcher) RuleSet() RuleSet {
+	if m == nil {
+		return RuleSet{}
+	}
+
+	return m.rules
+}
+
+// Domains returns all domains of the indexed rules.
+func (m *Matcher) Domains() []string {
+	if m == nil {
+		return nil
+	}
+
+	return m.domains
+}
+
+// Selection is the result of matching a URL against a ruleset.
+type Selection struct {
+	// Rule is the merged rule for the URL.
+	Rule Rule
+	// MatchedBy describes which matcher selected each merged rule, most specific first,
+	// e.g. `example.com pathPatterns:/*/article/*`.
+	MatchedBy []string
+}
+
+// Match returns the rule for a host and path. The host may include a port.
+// It is a shorthand for Select on a https URL.
+func (m *Matcher) Match(host string, path string) (Rule, bool) {
+	sel, ok := m.Select(&url.URL{Scheme: "https", Host: host, Path: path})
+	return sel.Rule, ok
+}
+
+// Select returns the rule for a URL.
+// If several rules apply, they are merged by specificity (see Merge).
+// A rule is more specific than another if it
+//  1. matches more labels of the host, so an exact host beats a parent domain,
+//  2. matches the URL with a longer path, path pattern or URL regex, so a path match
+//     beats a domain-only rule,
+//  3. has a higher priority,
+//  4. is declared first.
+//
+// Merging starts at the most specific rule and stops after the first rule that is final.
+func (m *Matcher) Select(u *url.URL) (Selection, bool) {
+	candidates := m.candidates(u)
+	if len(candidates) == 0 {
+		return Selection{}, false
+	}
+
+	rules := make([]Rule, 0, len(candidates))
+	matchedBy := make([]string, 0, len(candidates))
+
+	for _, c := range candidates {
+		rules = append(rules, m.rules[c.idx])
+		matchedBy = append(matchedBy, c.domain+" "+c.matchedBy)
+
+		if m.rules[c.idx].Final {
+			break
+		}
+	}
+
+	return Selection{Rule: Merge(rules...), MatchedBy: matchedBy}, true
+}
+
+// candidate is a rule that applies to a request, with the specificity of the match.
+type candidate struct {
+	idx       int
+	domain    string // the indexed domain that matched the host
+	depth     int    // number of matched host labels
+	path      int    // specificity of the path match, 0 for domain-only rules
+	matchedBy string
+}
+
+// candidates returns the rules that apply to a URL, most specific first.
+func (m *Matcher) candidates(u *url.URL) []candidate {
+	if m == nil || len(m.rules) == 0 {
+		return nil
+	}
+
+	// a rule can be indexed under several domains; keep its most specific match
+	matches := map[int]candidate{}
+	node := m.root
+
+	labels := domainLabels(u.Hostname())
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.children[labels[i]]
+		if node == nil {
+			break
+		}
+
+		for _, idx := range node.rules {
+			p, by, ok := m.rules[idx].matchURL(u)
+			if !ok {
+				continue
+			}
+			matches[idx] = candidate{
+				idx:       idx,
+				domain:    strings.Join(labels[i:], "."),
+				depth:     len(labels) - i,
+				path:      p,
+				matchedBy: by,
+			}
+		}
+	}
+
+	candidates := make([]candidate, 0, len(matches))
+	for _, c := range matches {
+		candidates = append(candidates, c)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		switch {
+		case a.depth != b.depth:
+			return a.depth > b.depth
+		case a.path != b.path:
+			return a.path > b.path
+		case m.rules[a.idx].Priority != m.rules[b.idx].Priority:
+			return m.rules[a.idx].Priority > m.rules[b.idx].Priority
+		default:
+			return a.idx < b.idx
+		}
+	})
+
+	return candidates
+}
+
+// AllDomains returns the domain and domains of a rule as a single slice.
+func (rule *Rule) AllDomains() []string {
+	domains := make([]string, 0, len(rule.Domains)+1)
+	if rule.Domain != "" {
+		domains = append(domains, rule.Domain)
+	}
+	for _, domain := range rule.Domains {
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
+
+// matchURL reports whether the path matchers of a rule select a URL. It returns the
+// specificity of the match, the length of the matching path, pattern or regex, and a
+// description of the matcher.
+// Rules without paths, pathPatterns or urlRegex match every URL with specificity 0.
+// A URL with an excluded path never matches.
+func (rule *Rule) matchURL(u *url.URL) (int, string, bool) {
+	for _, re := range rule.excludePaths {
+		if re.MatchString(u.Path) {
+			return 0, "", false
+		}
+	}
+
+	if len(rule.Paths) == 0 && len(rule.PathPatterns) == 0 && rule.URLRegex == "" {
+		return 0, "domain", true
+	}
+
+	longest, by := -1, ""
+	for _, p := range rule.Paths {
+		if strings.HasPrefix(u.Path, p) && len(p) > longest {
+			longest, by = len(p), "paths:"+p
+		}
+	}
+
+	for i, p := range rule.PathPatterns {
+		if rule.pathPatterns[i].MatchString(u.Path) && len(p) > longest {
+			longest, by = len(p), "pathPatterns:"+p
+		}
+	}
+
+	if rule.urlRegex != nil && rule.urlRegex.MatchString(u.String()) && len(rule.URLRegex) > longest {
+		longest, by = len(rule.URLRegex), "urlRegex:"+rule.URLRegex
+	}
+
+	if longest == -1 {
+		return 0, "", false
+	}
+
+	return longest, by, true
+}
+
+func domainLabels(domain string) []string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if domain == "" {
+		return nil
+	}
+
+	return strings.Split(domain, ".")
+}
@@ -0,0 +1,282 @@
+package ruleset
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatcher(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- domain: nytimes.com
+  headers:
+    referer: first
+- domains:
+  - www.example.com
+  - example.org
+  paths:
+    - /article
+- domain: nytimes.com
+  headers:
+    referer: second
+`)
+	assert.NoError(t, err)
+
+	m, err := NewMatcher(rs)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		host    string
+		path    string
+		matches bool
+	}{
+		{"nytimes.com", "/", true},
+		{"www.nytimes.com", "/", true},
+		{"WWW.NYTimes.com.", "/", true},
+		{"www.nytimes.com:443", "/", true},
+		{"evil-nytimes.com", "/", false},
+		{"nytimes.com.evil.org", "/", false},
+		{"com", "/", false},
+		{"www.example.com", "/article/1", true},
+		{"www.example.com", "/about", false},
+		{"example.com", "/article/1", false},
+		{"sub.example.org", "/article", true},
+	}
+
+	for _, tc := range testCases {
+		_, ok := m.Match(tc.host, tc.path)
+		assert.Equal(t, tc.matches, ok, "%s%s", tc.host, tc.path)
+	}
+
+	// first declared rule wins
+	rule, _ := m.Match("www.nytimes.com", "/")
+	assert.Equal(t, "first", rule.Headers.Referer)
+
+	var empty *Matcher
+	_, ok := empty.Match("nytimes.com", "/")
+	assert.False(t, ok)
+}
+
+func TestCompileRejectsInvalidRules(t *testing.T) {
+	_, err := loadRuleFromString(`
+- domain: example.com
+  regexRules:
+    - match: "[incomplete"
+      replace: ""`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 4: invalid regex '[incomplete'")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  urlMods:
+    path:
+      - match: "(unclosed"
+        replace: ""`)
+	assert.Error(t, err)
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  injections:
+    - position: "div["
+      append: "<p></p>"`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 4: invalid selector 'div['")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  requestHeaders:
+    - name: "Bad Header"
+      value: x`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 4: invalid header name 'Bad Header'")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  responseHeaders:
+    - name: X-Frame-Options
+      op: replace`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 4: invalid header op 'replace'")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  injections:
+    - position: .banner
+      limit: 1`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 4: injection for '.banner' has no operation")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  runtime: worker`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: invalid runtime 'worker'")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  redirects: manual`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: invalid redirects 'manual'")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  methods: ["GET POST"]`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: invalid method 'GET POST'")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  transport:
+    timeout: -1s`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: transport timeouts must not be negative")
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  transport:
+    timeout: 30`)
+	assert.Error(t, err)
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  cache:
+    ttl: -5m`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: cache ttl must not be negative")
+	}
+
+	rs, err := loadRuleFromString(validYAML)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com", rs[0].RegexRules[0].Regexp().ReplaceAllString("http://example.com", rs[0].RegexRules[0].Replace))
+}
+
+func TestMatcherMergesBySpecificity(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- domain: example.com
+  headers:
+    user-agent: broad
+    referer: broad
+  transport:
+    dialTimeout: 2s
+    timeout: 30s
+  regexRules:
+    - match: broad
+      replace: ""
+- domain: example.com
+  paths:
+    - /article
+  headers:
+    user-agent: path
+  transport:
+    timeout: 2m
+  regexRules:
+    - match: path
+      replace: ""
+- domain: www.example.com
+  headers:
+    cookie: exact
+  regexRules:
+    - match: exact
+      replace: ""
+- domain: example.com
+  priority: 10
+  headers:
+    user-agent: priority
+- domain: example.org
+  headers:
+    referer: broad
+- domain: www.example.org
+  final: true
+  headers:
+    user-agent: final
+`)
+	assert.NoError(t, err)
+
+	m, err := NewMatcher(rs)
+	assert.NoError(t, err)
+
+	matches := func(rule Rule) []string {
+		var s []string
+		for _, r := range rule.RegexRules {
+			s = append(s, r.Match)
+		}
+		return s
+	}
+
+	// exact host > path > priority > declaration order
+	rule, ok := m.Match("www.example.com", "/article/1")
+	assert.True(t, ok)
+	assert.Equal(t, "path", rule.Headers.UserAgent)
+	assert.Equal(t, "broad", rule.Headers.Referer)
+	assert.Equal(t, "exact", rule.Headers.Cookie)
+	assert.Equal(t, []string{"broad", "path", "exact"}, matches(rule))
+	assert.Equal(t, "www.example.com", rule.Domain)
+	assert.Equal(t, Transport{DialTimeout: 2 * time.Second, Timeout: 2 * time.Minute}, rule.Transport)
+
+	rule, _ = m.Match("example.com", "/")
+	assert.Equal(t, "priority", rule.Headers.UserAgent)
+	assert.Equal(t, []string{"broad"}, matches(rule))
+
+	// a final rule stops the cascade
+	rule, _ = m.Match("www.example.org", "/")
+	assert.Equal(t, "final", rule.Headers.UserAgent)
+	assert.Empty(t, rule.Headers.Referer)
+}
+
+func TestMatcherPathMatchers(t *testing.T) {
+	rs, err := loadRuleFromString(`
+- domain: example.com
+  pathPatterns:
+    - /*/article/*
+    - /archive/**
+  excludePaths:
+    - /live/
+    - /*/article/*.amp
+- domain: example.org
+  urlRegex: '[?&]id=\d+'
+`)
+	assert.NoError(t, err)
+
+	m, err := NewMatcher(rs)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		url       string
+		matchedBy []string
+	}{
+		{"https://example.com/world/article/foo", []string{"example.com pathPatterns:/*/article/*"}},
+		{"https://example.com/world/sub/article/foo", nil},
+		{"https://example.com/archive/2024/01/foo", []string{"example.com pathPatterns:/archive/**"}},
+		{"https://example.com/world/article/foo.amp", nil},
+		{"https://example.com/live/article/foo", nil},
+		{"https://www.example.org/page?id=42", []string{"example.org urlRegex:[?&]id=\\d+"}},
+		{"https://www.example.org/page?id=abc", nil},
+	}
+
+	for _, tc := range testCases {
+		u, _ := url.Parse(tc.url)
+		sel, ok := m.Select(u)
+		assert.Equal(t, tc.matchedBy != nil, ok, tc.url)
+		assert.Equal(t, tc.matchedBy, sel.MatchedBy, tc.url)
+	}
+
+	_, err = loadRuleFromString(`
+- domain: example.com
+  pathPatterns:
+    - article/*
+`)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2: invalid path pattern 'article/*'")
+	}
+}
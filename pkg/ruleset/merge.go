@@ -0,0 +1,162 @@
+package ruleset
+
+// Merge combines rules into a single rule. The rules must be ordered from the most
+// specific to the least specific, as returned by the Matcher.
+//
+//   - each header is taken from the most specific rule that sets it
+//   - headerPolicy is taken from the most specific rule that sets it
+//   - requestHeaders and responseHeaders are concatenated, least specific first, so a more
+//     specific rule overrides the operations of broader ones on the same header
+//   - googleCache and useFlareSolverr are enabled if any rule enables them
+//   - redirects, runtime, methods and proxy are taken from the most specific rule that sets them
+//   - the cache ttl is taken from the most specific rule that sets it, the cache is disabled if
+//     any rule disables it
+//   - each transport setting is taken from the most specific rule that sets it, disableHTTP2
+//     is enabled if any rule enables it
+//   - regexRules, injections and urlMods are concatenated, least specific first, so the
+//     modifications of a more specific rule run after, and can build on, broader ones
+//   - the `when` of each rule is moved to its regexRules, injections and responseHeaders, so
+//     it keeps restricting only the modifications of that rule
+//   - domains, path matchers, priority, final, tests and the source are those of the most specific rule
+func Merge(rules ...Rule) Rule {
+	if len(rules) == 0 {
+		return Rule{}
+	}
+	if len(rules) == 1 {
+		return rules[0].pushDownWhen()
+	}
+
+	merged := Rule{
+		Domain:       rules[0].Domain,
+		Domains:      rules[0].Domains,
+		Paths:        rules[0].Paths,
+		PathPatterns: rules[0].PathPatterns,
+		URLRegex:     rules[0].URLRegex,
+		ExcludePaths: rules[0].ExcludePaths,
+		Priority:     rules[0].Priority,
+		Final:        rules[0].Final,
+		Tests:        rules[0].Tests,
+		source:       rules[0].source,
+		pathPatterns: rules[0].pathPatterns,
+		urlRegex:     rules[0].urlRegex,
+		excludePaths: rules[0].excludePaths,
+	}
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i].pushDownWhen()
+
+		mergeString(&merged.Headers.UserAgent, rule.Headers.UserAgent)
+		mergeString(&merged.Headers.XForwardedFor, rule.Headers.XForwardedFor)
+		mergeString(&merged.Headers.Referer, rule.Headers.Referer)
+		mergeString(&merged.Headers.Cookie, rule.Headers.Cookie)
+		mergeString(&merged.Headers.CSP, rule.Headers.CSP)
+
+		merged.RequestHeaders = append(merged.RequestHeaders, rule.RequestHeaders...)
+		merged.ResponseHeaders = append(merged.ResponseHeaders, rule.ResponseHeaders...)
+		if len(rule.HeaderPolicy.Allow) > 0 || len(rule.HeaderPolicy.Deny) > 0 {
+			merged.HeaderPolicy = rule.HeaderPolicy
+		}
+
+		merged.GoogleCache = merged.GoogleCache || rule.GoogleCache
+		merged.UseFlareSolverr = merged.UseFlareSolverr || rule.UseFlareSolverr
+		mergeString(&merged.Redirects, rule.Redirects)
+		mergeString(&merged.Runtime, rule.Runtime)
+		mergeString(&merged.Proxy, rule.Proxy)
+		if len(rule.Methods) > 0 {
+			merged.Methods = rule.Methods
+		}
+		mergeTransport(&merged.Transport, rule.Transport)
+		if rule.Cache.TTL != 0 {
+			merged.Cache.TTL = rule.Cache.TTL
+		}
+		merged.Cache.Disabled = merged.Cache.Disabled || rule.Cache.Disabled
+
+		merged.RegexRules = append(merged.RegexRules, rule.RegexRules...)
+		merged.Injections = append(merged.Injections, rule.Injections...)
+
+		merged.URLMods.Domain = append(merged.URLMods.Domain, rule.URLMods.Domain...)
+		merged.URLMods.Path = append(merged.URLMods.Path, rule.URLMods.Path...)
+		merged.URLMods.Query = append(merged.URLMods.Query, rule.URLMods.Query...)
+	}
+
+	return merged
+}
+
+// mergeString overrides dst with src, unless src is empty.
+func mergeString(dst *string, src string) {
+	if src != "" {
+		*dst = src
+	}
+}
+
+// mergeTransport overrides the settings of dst with those src sets.
+func mergeTransport(dst *Transport, src Transport) {
+	if src.DialTimeout != 0 {
+		dst.DialTimeout = src.DialTimeout
+	}
+	if src.TLSHandshakeTimeout != 0 {
+		dst.TLSHandshakeTimeout = src.TLSHandshakeTimeout
+	}
+	if src.ResponseHeaderTimeout != 0 {
+		dst.ResponseHeaderTimeout = src.ResponseHeaderTimeout
+	}
+	if src.Timeout != 0 {
+		dst.Timeout = src.Timeout
+	}
+	if src.StreamIdleTimeout != 0 {
+		dst.StreamIdleTimeout = src.StreamIdleTimeout
+	}
+	if src.StreamTimeout != 0 {
+		dst.StreamTimeout = src.StreamTimeout
+	}
+	if src.MaxIdleConnsPerHost != 0 {
+		dst.MaxIdleConnsPerHost = src.MaxIdleConnsPerHost
+	}
+	if src.MaxConnsPerHost != 0 {
+		dst.MaxConnsPerHost = src.MaxConnsPerHost
+	}
+	dst.DisableHTTP2 = dst.DisableHTTP2 || src.DisableHTTP2
+}
+
+// WithDefaults returns the transport settings with those it does not set taken from defaults.
+func (t Transport) WithDefaults(defaults Transport) Transport {
+	mergeTransport(&defaults, t)
+	return defaults
+}
+
+// pushDownWhen returns a copy of the rule with its `when` added to the conditions of its
+// regexRules, injections and responseHeaders.
+func (rule Rule) pushDownWhen() Rule {
+	if len(rule.When) == 0 {
+		return rule
+	}
+
+	when := func(own Conditions) Conditions {
+		return append(append(Conditions(nil), rule.When...), own...)
+	}
+
+	regexRules := make([]Regex, len(rule.RegexRules))
+	for i, r := range rule.RegexRules {
+		r.When = when(r.When)
+		regexRules[i] = r
+	}
+
+	injections := make([]Injection, len(rule.Injections))
+	for i, injection := range rule.Injections {
+		injection.When = when(injection.When)
+		injections[i] = injection
+	}
+
+	responseHeaders := make([]HeaderRule, len(rule.ResponseHeaders))
+	for i, h := range rule.ResponseHeaders {
+		h.When = when(h.When)
+		responseHeaders[i] = h
+	}
+
+	rule.RegexRules = regexRules
+	rule.Injections = injections
+	rule.ResponseHeaders = responseHeaders
+	rule.When = nil
+
+	return rule
+}
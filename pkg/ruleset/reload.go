@@ -0,0 +1,379 @@
+package ruleset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader keeps a ruleset up to date while the server is running.
+// Local files and directories are checked for modified YAML files and the files their
+// injections include, remote URLs are polled with conditional requests (ETag / If-Modified-Since).
+//
+// The current ruleset is swapped atomically: a request that fetched the Matcher
+// keeps using it, even if a reload happens in the meantime. A reload that fails
+// keeps the last good ruleset.
+type Reloader struct {
+	current atomic.Pointer[Matcher]
+	sources []source
+
+	mu sync.Mutex // serializes reloads
+}
+
+// source is a single entry of the semicolon separated RULESET paths.
+// load returns the rules of the source and whether they changed since the last load.
+// When force is false, a source may skip loading and return its previous rules.
+type source interface {
+	load(force bool) (rs RuleSet, changed bool, err error)
+	String() string
+}
+
+// NewReloaderFromEnv creates a new Reloader based on the RULESET environment variable.
+// It logs a warning and returns a Reloader with an empty RuleSet if the RULESET
+// environment variable is not set, or if the rules cannot be loaded.
+func NewReloaderFromEnv() *Reloader {
+	rulesPath, ok := os.LookupEnv("RULESET")
+	if !ok {
+		log.Printf("WARN: No ruleset specified. Set the `RULESET` environment variable to load one for a better success rate.")
+
+		r := &Reloader{}
+		m, _ := NewMatcher(RuleSet{})
+		r.current.Store(m)
+
+		return r
+	}
+
+	r, err := NewReloader(rulesPath)
+	if err != nil {
+		log.Println(err)
+	}
+
+	return r
+}
+
+// NewReloader loads a RuleSet from a given string of rule paths, separated by semicolons,
+// and keeps track of the sources so they can be reloaded later.
+// Like NewRuleset, the initial load skips invalid files of a directory. If any
+// source fails, the rules that could be loaded are used and an error is returned.
+func NewReloader(rulePaths string) (*Reloader, error) {
+	r := &Reloader{}
+
+	for _, rulePath := range strings.Split(rulePaths, ";") {
+		rulePath = strings.Trim(rulePath, " ")
+		if remoteRegex.MatchString(rulePath) {
+			r.sources = append(r.sources, &remoteSource{url: rulePath})
+		} else {
+			r.sources = append(r.sources, &localSource{path: rulePath})
+		}
+	}
+
+	var ruleSet RuleSet
+	var errs []error
+
+	for _, src := range r.sources {
+		var rs RuleSet
+		var err error
+
+		switch s := src.(type) {
+		case *localSource:
+			rs, err = s.loadLenient()
+		default:
+			rs, _, err = s.load(true)
+		}
+
+		if err != nil {
+			e := fmt.Errorf("WARN: failed to load ruleset from '%s'", src)
+			errs = append(errs, errors.Join(e, err))
+
+			continue
+		}
+
+		ruleSet = append(ruleSet, rs...)
+	}
+
+	ruleSet, err := ruleSet.Resolve()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	m, err := NewMatcher(ruleSet)
+	if err != nil {
+		errs = append(errs, err)
+		m, _ = NewMatcher(RuleSet{})
+		ruleSet = RuleSet{}
+	}
+	r.current.Store(m)
+	ruleSet.PrintStats()
+
+	return r, errors.Join(errs...)
+}
+
+// Current returns the Matcher for the most recently loaded ruleset.
+func (r *Reloader) Current() *Matcher {
+	if r == nil {
+		return nil
+	}
+
+	return r.current.Load()
+}
+
+// Reload reloads every source, whether it changed or not.
+func (r *Reloader) Reload() error {
+	return r.reload(true)
+}
+
+// Check reloads the ruleset if any of its sources changed.
+func (r *Reloader) Check() error {
+	return r.reload(false)
+}
+
+// Watch checks the sources for changes every interval until ctx is cancelled.
+// Failed reloads are logged and the last good ruleset is kept.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Check(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(force bool) error {
+	if r == nil || len(r.sources) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ruleSet RuleSet
+	var errs []error
+
+	anyChanged := false
+
+	for _, src := range r.sources {
+		rs, changed, err := src.load(force)
+		if err != nil {
+			e := fmt.Errorf("WARN: failed to reload ruleset from '%s'", src)
+			errs = append(errs, errors.Join(e, err))
+
+			continue
+		}
+
+		anyChanged = anyChanged || changed
+		ruleSet = append(ruleSet, rs...)
+	}
+
+	if len(errs) != 0 {
+		e := errors.New("WARN: keeping the previous ruleset")
+		return errors.Join(append(errs, e)...)
+	}
+
+	if !anyChanged && !force {
+		return nil
+	}
+
+	ruleSet, err := ruleSet.Resolve()
+	if err != nil {
+		return errors.Join(err, errors.New("WARN: keeping the previous ruleset"))
+	}
+
+	m, err := NewMatcher(ruleSet)
+	if err != nil {
+		return errors.Join(err, errors.New("WARN: keeping the previous ruleset"))
+	}
+
+	r.current.Store(m)
+	log.Printf("INFO: reloaded ruleset")
+	ruleSet.PrintStats()
+
+	return nil
+}
+
+// localSource is a local YAML file or a directory of YAML files.
+type localSource struct {
+	path        string
+	fingerprint string
+	includes    []string // the files included by the rules, which may be outside path
+	rules       RuleSet
+}
+
+func (s *localSource) String() string {
+	return s.path
+}
+
+// loadLenient loads the source the same way NewRuleset does, skipping invalid files.
+func (s *localSource) loadLenient() (RuleSet, error) {
+	fingerprint, err := localFingerprint(s.path, s.includes)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs RuleSet
+	if err := rs.loadRulesFromLocalDir(s.path); err != nil {
+		return nil, err
+	}
+
+	return rs, s.update(rs, fingerprint)
+}
+
+// load reloads all files of the source if any of them, any file next to them, or any file
+// included by their rules was added, removed or modified.
+// Unlike the initial load, an invalid file fails the whole reload.
+func (s *localSource) load(force bool) (RuleSet, bool, error) {
+	fingerprint, err := localFingerprint(s.path, s.includes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !force && fingerprint == s.fingerprint {
+		return s.rules, false, nil
+	}
+
+	var rs RuleSet
+
+	err = rs.walkLocalDir(s.path, func(path string, err error) error {
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := s.update(rs, fingerprint); err != nil {
+		return nil, false, err
+	}
+
+	return rs, true, nil
+}
+
+// update records the loaded rules and the fingerprint taken before loading them. If the rules
+// include other files than before, the fingerprint is taken again to cover them.
+func (s *localSource) update(rs RuleSet, fingerprint string) error {
+	if includes := rs.includes(); !slices.Equal(includes, s.includes) {
+		s.includes = includes
+
+		var err error
+		if fingerprint, err = localFingerprint(s.path, includes); err != nil {
+			return err
+		}
+	}
+
+	s.fingerprint = fingerprint
+	s.rules = rs
+
+	return nil
+}
+
+// includes returns the paths of the files included by the injections of the rules.
+func (rs RuleSet) includes() []string {
+	var paths []string
+	for _, rule := range rs {
+		for _, injection := range rule.Injections {
+			if injection.Include != "" {
+				paths = append(paths, filepath.Join(filepath.Dir(rule.source), injection.Include))
+			}
+		}
+	}
+
+	return paths
+}
+
+// localFingerprint hashes the name, size and modification time of every file below path,
+// and of the included files, which may be outside of it. A missing included file is hashed
+// as missing, so creating it triggers a reload.
+func localFingerprint(path string, includes []string) (string, error) {
+	h := sha256.New()
+
+	err := filepath.WalkDir(path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", path, info.Size(), info.ModTime().UnixNano())
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	for _, include := range includes {
+		info, err := os.Stat(include)
+		if err != nil {
+			fmt.Fprintf(h, "%s\x00missing\n", include)
+			continue
+		}
+
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", include, info.Size(), info.ModTime().UnixNano())
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// remoteSource is a YAML or gzipped YAML file served over HTTP(S).
+type remoteSource struct {
+	url          string
+	etag         string
+	lastModified string
+	rules        RuleSet
+}
+
+func (s *remoteSource) String() string {
+	return s.url
+}
+
+// load fetches the remote rules. Unless force is set, the request is conditional
+// and a 304 Not Modified response keeps the previous rules.
+func (s *remoteSource) load(force bool) (RuleSet, bool, error) {
+	header := http.Header{}
+	if !force {
+		if s.etag != "" {
+			header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+
+	rs, resp, err := fetchRemoteRules(s.url, header)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if resp.StatusCode == http.StatusNotModified {
+		return s.rules, false, nil
+	}
+
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	s.rules = rs
+
+	return rs, true, nil
+}
@@ -0,0 +1,121 @@
+package ruleset
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloaderLocalDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.yaml")
+
+	err := os.WriteFile(file, []byte(validYAML), 0o644)
+	assert.NoError(t, err)
+
+	r, err := NewReloader(dir)
+	assert.NoError(t, err)
+
+	before := r.Current()
+	_, ok := before.Match("example.com", "/")
+	assert.True(t, ok)
+
+	// nothing changed
+	assert.NoError(t, r.Check())
+	assert.Same(t, before, r.Current())
+
+	// a new file is picked up
+	err = os.WriteFile(filepath.Join(dir, "more.yaml"), []byte("- domain: example.org\n"), 0o644)
+	assert.NoError(t, err)
+	assert.NoError(t, r.Check())
+
+	_, ok = r.Current().Match("example.org", "/")
+	assert.True(t, ok)
+
+	// the Matcher fetched before the reload is unchanged
+	_, ok = before.Match("example.org", "/")
+	assert.False(t, ok)
+
+	// an invalid file fails the reload and keeps the last good ruleset
+	good := r.Current()
+	err = os.WriteFile(file, []byte(invalidYAML), 0o644)
+	assert.NoError(t, err)
+	os.Chtimes(file, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+	assert.Error(t, r.Check())
+	assert.Same(t, good, r.Current())
+}
+
+func TestReloaderRemoteConditional(t *testing.T) {
+	requests := 0
+	body := validYAML
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("If-None-Match") == `"v1"` && body == validYAML {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	r, err := NewReloader(srv.URL + "/ruleset.yaml")
+	assert.NoError(t, err)
+
+	before := r.Current()
+	assert.NoError(t, r.Check())
+	assert.Same(t, before, r.Current())
+	assert.Equal(t, 2, requests)
+
+	// a forced reload always builds a new ruleset
+	assert.NoError(t, r.Reload())
+	assert.NotSame(t, before, r.Current())
+
+	// a broken remote ruleset keeps the last good one
+	body = invalidYAML
+	good := r.Current()
+	assert.Error(t, r.Check())
+	assert.Same(t, good, r.Current())
+	assert.Equal(t, "example.com", r.Current().RuleSet()[0].Domain)
+}
+
+func TestReloaderLocalFileIncludes(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "rules.yaml")
+	include := filepath.Join(dir, "_fragments", "banner.js")
+
+	assert.NoError(t, os.Mkdir(filepath.Dir(include), 0o755))
+	assert.NoError(t, os.WriteFile(include, []byte("one()"), 0o644))
+	assert.NoError(t, os.WriteFile(file, []byte(`
+- domain: example.com
+  injections:
+    - position: head
+      include: _fragments/banner.js
+`), 0o644))
+
+	r, err := NewReloader(file)
+	assert.NoError(t, err)
+
+	// nothing changed
+	before := r.Current()
+	assert.NoError(t, r.Check())
+	assert.Same(t, before, r.Current())
+
+	// the included file is watched, although it is not below the configured path
+	assert.NoError(t, os.WriteFile(include, []byte("two()"), 0o644))
+	os.Chtimes(include, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	assert.NoError(t, r.Check())
+
+	rule, ok := r.Current().Match("example.com", "/")
+	if assert.True(t, ok) {
+		assert.Contains(t, rule.Injections[0].Append, "two()")
+	}
+}
@@ -1,6 +1,7 @@
 package ruleset
 
 import (
+	"bytes"
 	"compress/gzip"
 	"errors"
 	"fmt"
@@ -11,14 +12,23 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"ladder/pkg/outbound"
+
+	"github.com/andybalholm/cascadia"
 	"gopkg.in/yaml.v3"
 )
 
 type Regex struct {
-	Match   string `yaml:"match"`
-	Replace string `yaml:"replace"`
+	Match   string     `yaml:"match"`
+	Replace string     `yaml:"replace"`
+	When    Conditions `yaml:"when,omitempty"` // only for regexRules
+
+	re *regexp.Regexp
 }
+
 type KV struct {
 	Key   string `yaml:"key"`
 	Value string `yaml:"value"`
@@ -27,9 +37,28 @@ type KV struct {
 type RuleSet []Rule
 
 type Rule struct {
+	Fragment string   `yaml:"fragment,omitempty"`
+	Extends  []string `yaml:"extends,omitempty"`
+
 	Domain  string   `yaml:"domain,omitempty"`
 	Domains []string `yaml:"domains,omitempty"`
 	Paths   []string `yaml:"paths,omitempty"`
+
+	PathPatterns []string `yaml:"pathPatterns,omitempty"`
+	URLRegex     string   `yaml:"urlRegex,omitempty"`
+	ExcludePaths []string `yaml:"excludePaths,omitempty"`
+
+	Priority int  `yaml:"priority,omitempty"`
+	Final    bool `yaml:"final,omitempty"`
+
+	// Methods are the HTTP methods that are forwarded to the upstream, all if empty.
+	// HEAD is allowed wherever GET is.
+	Methods []string `yaml:"methods,omitempty"`
+
+	// When restricts the response modifications of the rule (regexRules, injections and
+	// responseHeaders) to some upstream responses.
+	When Conditions `yaml:"when,omitempty"`
+
 	Headers struct {
 		UserAgent     string `yaml:"user-agent,omitempty"`
 		XForwardedFor string `yaml:"x-forwarded-for,omitempty"`
@@ -37,24 +66,162 @@ type Rule struct {
 		Cookie        string `yaml:"cookie,omitempty"`
 		CSP           string `yaml:"content-security-policy,omitempty"`
 	} `yaml:"headers,omitempty"`
+
+	RequestHeaders  []HeaderRule `yaml:"requestHeaders,omitempty"`
+	ResponseHeaders []HeaderRule `yaml:"responseHeaders,omitempty"`
+	HeaderPolicy    HeaderPolicy `yaml:"headerPolicy,omitempty"`
+
 	GoogleCache     bool    `yaml:"googleCache,omitempty"`
 	UseFlareSolverr bool    `yaml:"useFlareSolverr,omitempty"`
 	RegexRules      []Regex `yaml:"regexRules,omitempty"`
 
+	// Redirects is the redirect policy for upstream responses of the rule: follow or pass.
+	// Empty uses the default of the proxy.
+	Redirects string `yaml:"redirects,omitempty"`
+
+	// Runtime is the client runtime injected into HTML pages: off, shim or serviceWorker.
+	// Empty uses the default of the proxy.
+	Runtime string `yaml:"runtime,omitempty"`
+
+	// Transport overrides the connection settings of the proxy for upstream requests of the rule.
+	Transport Transport `yaml:"transport,omitempty"`
+
+	// Cache overrides how the upstream responses of the rule are cached.
+	Cache Cache `yaml:"cache,omitempty"`
+
+	// Proxy is the outbound proxy for upstream requests of the rule: an http, https, socks5 or
+	// socks5h URL, or direct. Empty uses the default of the proxy.
+	Proxy string `yaml:"proxy,omitempty"`
+
 	URLMods struct {
 		Domain []Regex `yaml:"domain,omitempty"`
 		Path   []Regex `yaml:"path,omitempty"`
 		Query  []KV    `yaml:"query,omitempty"`
 	} `yaml:"urlMods,omitempty"`
 
-	Injections []struct {
-		Position string `yaml:"position,omitempty"`
-		Append   string `yaml:"append,omitempty"`
-		Prepend  string `yaml:"prepend,omitempty"`
-		Replace  string `yaml:"replace,omitempty"`
-	} `yaml:"injections,omitempty"`
+	Injections []Injection `yaml:"injections,omitempty"`
+
+	Tests []RuleTest `yaml:"tests,omitempty"`
+
+	source       string
+	pathPatterns []*regexp.Regexp
+	urlRegex     *regexp.Regexp
+	excludePaths []*regexp.Regexp
+}
+
+// HeaderRule sets, appends or deletes a request or response header.
+// A value of `none` deletes the header, like in `headers`.
+type HeaderRule struct {
+	Name  string     `yaml:"name"`
+	Value string     `yaml:"value,omitempty"`
+	Op    string     `yaml:"op,omitempty"`   // set (default), append or delete
+	When  Conditions `yaml:"when,omitempty"` // only for responseHeaders
+}
+
+// The client runtimes. The shim patches the browser APIs scripts use to build URLs, so the
+// requests they make go through the proxy. serviceWorker also registers a service worker
+// that routes every request of proxied pages through the proxy.
+const (
+	RuntimeOff           = "off"
+	RuntimeShim          = "shim"
+	RuntimeServiceWorker = "serviceWorker"
+)
+
+// The redirect policies. follow follows redirects in the proxy, selecting the rule of every
+// hop again. pass sends redirects to the client with their Location in the proxy URL space.
+const (
+	RedirectFollow = "follow"
+	RedirectPass   = "pass"
+)
+
+// HeaderPolicy overrides which upstream response headers are passed to the client.
+// A header in Deny is stripped, a header in Allow is passed, other headers are left to
+// the default policy of the proxy.
+type HeaderPolicy struct {
+	Allow []string `yaml:"allow,omitempty"` // * allows all headers
+	Deny  []string `yaml:"deny,omitempty"`
 }
 
+// Transport tunes the connections to the upstreams of a rule. Durations are written like
+// 5s or 1m30s. Zero values use the defaults of the proxy.
+type Transport struct {
+	DialTimeout           time.Duration `yaml:"dialTimeout,omitempty"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout time.Duration `yaml:"responseHeaderTimeout,omitempty"`
+	// Timeout bounds a whole upstream request, until its body is read to the end. A body that
+	// is streamed to the client is bounded by StreamIdleTimeout and StreamTimeout instead.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// StreamIdleTimeout bounds the time a streamed body may send nothing.
+	StreamIdleTimeout time.Duration `yaml:"streamIdleTimeout,omitempty"`
+	// StreamTimeout bounds streaming a body to the client, from its first byte to its end.
+	StreamTimeout       time.Duration `yaml:"streamTimeout,omitempty"`
+	MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int           `yaml:"maxConnsPerHost,omitempty"`
+	DisableHTTP2        bool          `yaml:"disableHTTP2,omitempty"`
+}
+
+// Cache overrides the caching headers of the upstream responses of a rule.
+type Cache struct {
+	// TTL keeps responses fresh for this long, whatever their caching headers say.
+	TTL      time.Duration `yaml:"ttl,omitempty"`
+	Disabled bool          `yaml:"disabled,omitempty"`
+}
+
+const (
+	HeaderSet    = "set"
+	HeaderAppend = "append"
+	HeaderDelete = "delete"
+)
+
+// Injection modifies the elements matching the CSS selector in Position.
+// If an injection has several operations, they run in the order of the fields below.
+type Injection struct {
+	Position string     `yaml:"position,omitempty"`
+	Limit    int        `yaml:"limit,omitempty"` // only modify the first n matching elements, 0 = all
+	When     Conditions `yaml:"when,omitempty"`
+
+	Replace     string            `yaml:"replace,omitempty"`
+	SetText     string            `yaml:"setText,omitempty"`
+	SetAttr     map[string]string `yaml:"setAttr,omitempty"`
+	RemoveAttr  []string          `yaml:"removeAttr,omitempty"`
+	AddClass    string            `yaml:"addClass,omitempty"`
+	RemoveClass string            `yaml:"removeClass,omitempty"`
+	Prepend     string            `yaml:"prepend,omitempty"`
+	Append      string            `yaml:"append,omitempty"`
+	Include     string            `yaml:"include,omitempty"`
+	Before      string            `yaml:"before,omitempty"`
+	After       string            `yaml:"after,omitempty"`
+	Wrap        string            `yaml:"wrap,omitempty"`
+	Unwrap      bool              `yaml:"unwrap,omitempty"`
+	Remove      bool              `yaml:"remove,omitempty"`
+
+	selector cascadia.Selector
+	included string
+	line     int
+}
+
+// RuleTest is an offline test case for a rule. The HTML fixture, inline or from a file
+// relative to the ruleset file, is run through the rewrite pipeline as if it had been
+// fetched from URL, and the result is checked against the expectations.
+type RuleTest struct {
+	Name        string `yaml:"name,omitempty"`
+	URL         string `yaml:"url"`
+	HTML        string `yaml:"html,omitempty"`
+	File        string `yaml:"file,omitempty"`
+	ContentType string `yaml:"contentType,omitempty"`
+
+	Expect struct {
+		URL         string   `yaml:"url,omitempty"`
+		Present     []string `yaml:"present,omitempty"`
+		Absent      []string `yaml:"absent,omitempty"`
+		Text        []string `yaml:"text,omitempty"`
+		Contains    []string `yaml:"contains,omitempty"`
+		NotContains []string `yaml:"notContains,omitempty"`
+	} `yaml:"expect,omitempty"`
+}
+
+var yamlRegex = regexp.MustCompile(`.*\.ya?ml`)
+
 var remoteRegex = regexp.MustCompile(`^https?:\/\/(www\.)?[-a-zA-Z0-9@:%._\+~#=]{1,256}\.[a-zA-Z0-9()]{1,6}\b([-a-zA-Z0-9()!@:%_\+.~#?&\/\/=]*)`)
 
 // NewRulesetFromEnv creates a new RuleSet based on the RULESET environment variable.
@@ -77,8 +244,28 @@ func NewRulesetFromEnv() RuleSet {
 
 // NewRuleset loads a RuleSet from a given string of rule paths, separated by semicolons.
 // It supports loading rules from both local file paths and remote URLs.
+// Fragments are resolved, so the RuleSet only contains self-contained rules.
 // Returns a RuleSet and an error if any issues occur during loading.
 func NewRuleset(rulePaths string) (RuleSet, error) {
+	ruleSet, err := NewRulesetUnresolved(rulePaths)
+
+	ruleSet, resolveErr := ruleSet.Resolve()
+	if resolveErr != nil {
+		err = errors.Join(err, resolveErr)
+	}
+
+	if err != nil {
+		return ruleSet, err
+	}
+
+	ruleSet.PrintStats()
+
+	return ruleSet, nil
+}
+
+// NewRulesetUnresolved loads a RuleSet like NewRuleset, but keeps fragments, `extends`
+// and `include` references as they were declared.
+func NewRulesetUnresolved(rulePaths string) (RuleSet, error) {
 	var ruleSet RuleSet
 
 	var errs []error
@@ -121,8 +308,6 @@ func NewRuleset(rulePaths string) (RuleSet, error) {
 		return ruleSet, errors.Join(errs...)
 	}
 
-	ruleSet.PrintStats()
-
 	return ruleSet, nil
 }
 
@@ -133,14 +318,22 @@ func NewRuleset(rulePaths string) (RuleSet, error) {
 // Returns an error if the directory cannot be accessed
 // If there is an issue loading any file, it will be skipped
 func (rs *RuleSet) loadRulesFromLocalDir(path string) error {
+	return rs.walkLocalDir(path, func(path string, err error) error {
+		log.Printf("WARN: failed to load directory ruleset '%s': %s, skipping", path, err)
+		return nil
+	})
+}
+
+// walkLocalDir loads rules from every YAML file below path.
+// Errors loading a single file are passed to onError, which decides whether to
+// skip the file (return nil) or to abort the walk (return an error).
+func (rs *RuleSet) walkLocalDir(path string, onError func(path string, err error) error) error {
 	_, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
 
-	yamlRegex := regexp.MustCompile(`.*\.ya?ml`)
-
-	err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -153,20 +346,13 @@ func (rs *RuleSet) loadRulesFromLocalDir(path string) error {
 
 		err = rs.loadRulesFromLocalFile(path)
 		if err != nil {
-			log.Printf("WARN: failed to load directory ruleset '%s': %s, skipping", path, err)
-			return nil
+			return onError(path, err)
 		}
 
 		log.Printf("INFO: loaded ruleset %s\n", path)
 
 		return nil
 	})
-
-	if err != nil {
-		return err
-	}
-
-	return nil
 }
 
 // loadRulesFromLocalFile loads rules from a local YAML file specified by the path.
@@ -180,6 +366,11 @@ func (rs *RuleSet) loadRulesFromLocalFile(path string) error {
 
 	var r RuleSet
 	err = yaml.Unmarshal(yamlFile, &r)
+	r.setSource(path)
+
+	if err == nil {
+		err = r.loadIncludes(filepath.Dir(path))
+	}
 
 	if err != nil {
 		e := fmt.Errorf("failed to load rules from local file, possible syntax error in '%s'", path)
@@ -198,36 +389,85 @@ func (rs *RuleSet) loadRulesFromLocalFile(path string) error {
 }
 
 // loadRulesFromRemoteFile loads rules from a remote URL.
-// It supports plain and gzip compressed content.
+// It supports plain and gzip compressed content, and verifies the signature if
+// RULESET_PUBLIC_KEYS is set.
 // Returns an error if there's an issue accessing the URL or if there's a syntax error in the YAML.
 func (rs *RuleSet) loadRulesFromRemoteFile(rulesURL string) error {
+	r, _, err := fetchRemoteRules(rulesURL, nil)
+	if err != nil {
+		return err
+	}
+
+	*rs = append(*rs, r...)
+
+	return nil
+}
+
+// remoteClient returns the client that fetches remote rulesets and their signatures,
+// through the proxy in UPSTREAM_PROXY.
+var remoteClient = sync.OnceValues(func() (*http.Client, error) {
+	return outbound.Client(outbound.FromEnv())
+})
+
+// fetchRemoteRules fetches and decodes rules from a remote URL.
+// Additional request headers, such as If-None-Match, can be passed in header.
+// If the server answers 304 Not Modified, the returned RuleSet is nil.
+// The response is returned so callers can inspect caching headers; its body is already closed.
+func fetchRemoteRules(rulesURL string, header http.Header) (RuleSet, *http.Response, error) {
 	var r RuleSet
 
-	resp, err := http.Get(rulesURL)
+	req, err := http.NewRequest(http.MethodGet, rulesURL, nil)
 	if err != nil {
 		e := fmt.Errorf("failed to load rules from remote url '%s'", rulesURL)
-		return errors.Join(e, err)
+		return nil, nil, errors.Join(e, err)
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	client, err := remoteClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		e := fmt.Errorf("failed to load rules from remote url '%s'", rulesURL)
+		return nil, nil, errors.Join(e, err)
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, resp, nil
+	}
+
 	if resp.StatusCode >= 400 {
 		e := fmt.Errorf("failed to load rules from remote url (%s) on '%s'", resp.Status, rulesURL)
-		return errors.Join(e, err)
+		return nil, resp, errors.Join(e, err)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		e := fmt.Errorf("failed to load rules from remote url '%s'", rulesURL)
+		return nil, resp, errors.Join(e, err)
+	}
+
+	if err := verifyRemoteRules(rulesURL, data); err != nil {
+		return nil, resp, err
 	}
 
-	var reader io.Reader
+	var reader io.Reader = bytes.NewReader(data)
 
 	isGzip := strings.HasSuffix(rulesURL, ".gz") || strings.HasSuffix(rulesURL, ".gzip") || resp.Header.Get("content-encoding") == "gzip"
 
 	if isGzip {
-		reader, err = gzip.NewReader(resp.Body)
+		reader, err = gzip.NewReader(reader)
 
 		if err != nil {
-			return fmt.Errorf("failed to create gzip reader for URL '%s' with status code '%s': %w", rulesURL, resp.Status, err)
+			return nil, resp, fmt.Errorf("failed to create gzip reader for URL '%s' with status code '%s': %w", rulesURL, resp.Status, err)
 		}
-	} else {
-		reader = resp.Body
 	}
 
 	err = yaml.NewDecoder(reader).Decode(&r)
@@ -236,16 +476,36 @@ func (rs *RuleSet) loadRulesFromRemoteFile(rulesURL string) error {
 		e := fmt.Errorf("failed to load rules from remote url '%s' with status code '%s' and possible syntax error", rulesURL, resp.Status)
 		ee := errors.Join(e, err)
 
-		return ee
+		return nil, resp, ee
 	}
 
-	*rs = append(*rs, r...)
+	r.setSource(rulesURL)
 
-	return nil
+	for _, rule := range r {
+		for _, injection := range rule.Injections {
+			if injection.Include != "" {
+				return nil, resp, fmt.Errorf("line %d: include '%s' is not supported in remote rulesets, resolve it with --merge-rulesets", injection.line, injection.Include)
+			}
+		}
+	}
+
+	return r, resp, nil
 }
 
 // ================= utility methods ==========================
 
+// setSource records the file or URL the rules were loaded from.
+func (rs RuleSet) setSource(source string) {
+	for i := range rs {
+		rs[i].source = source
+	}
+}
+
+// Source returns the file or URL the rule was loaded from.
+func (rule *Rule) Source() string {
+	return rule.source
+}
+
 // Yaml returns the ruleset as a Yaml string
 func (rs *RuleSet) Yaml() (string, error) {
 	y, err := yaml.Marshal(rs)
@@ -280,8 +540,7 @@ func (rs *RuleSet) GzipYaml() (io.Reader, error) {
 func (rs *RuleSet) Domains() []string {
 	var domains []string
 	for _, rule := range *rs {
-		domains = append(domains, rule.Domain)
-		domains = append(domains, rule.Domains...)
+		domains = append(domains, rule.AllDomains()...)
 	}
 	return domains
 }
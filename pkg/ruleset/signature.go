@@ -0,0 +1,130 @@
+package ruleset
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Remote rulesets can be signed with a detached ed25519 signature, served next to the
+// ruleset with a .sig suffix (ruleset.yaml.sig, ruleset.gz.sig). The signature covers the
+// file as it is served, so gzip bundles are verified before they are decompressed.
+//
+// Keys and signatures are base64 encoded. If RULESET_PUBLIC_KEYS is set, every remote
+// ruleset must carry a valid signature by one of the keys, otherwise it is refused.
+// Local rulesets are trusted and never verified.
+
+const signatureSuffix = ".sig"
+
+// TrustedKeysFromEnv parses the public keys in the RULESET_PUBLIC_KEYS environment variable,
+// separated by semicolons. It returns no keys if the variable is not set.
+func TrustedKeysFromEnv() ([]ed25519.PublicKey, error) {
+	return ParsePublicKeys(os.Getenv("RULESET_PUBLIC_KEYS"))
+}
+
+// ParsePublicKeys parses base64 encoded ed25519 public keys, separated by semicolons.
+func ParsePublicKeys(s string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	for _, k := range strings.Split(s, ";") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(b) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ruleset public key '%s'", k)
+		}
+
+		keys = append(keys, ed25519.PublicKey(b))
+	}
+
+	return keys, nil
+}
+
+// GenerateKey creates a new key pair for signing rulesets.
+// It returns the base64 encoded public and private key.
+func GenerateKey() (publicKey string, privateKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+// Sign returns the base64 encoded detached signature of data, created with a base64 encoded
+// private key as returned by GenerateKey.
+func Sign(data []byte, privateKey string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(b) != ed25519.PrivateKeySize {
+		return "", errors.New("invalid ruleset private key")
+	}
+
+	sig := ed25519.Sign(ed25519.PrivateKey(b), data)
+
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// Verify checks that signature is a valid base64 encoded signature of data by any of keys.
+func Verify(data []byte, signature string, keys []ed25519.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("malformed ruleset signature")
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+
+	return errors.New("ruleset signature does not match any trusted key")
+}
+
+// verifyRemoteRules fetches the detached signature of a remote ruleset and verifies data
+// against the trusted keys. It does nothing if no keys are trusted.
+func verifyRemoteRules(rulesURL string, data []byte) error {
+	keys, err := TrustedKeysFromEnv()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	client, err := remoteClient()
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Get(rulesURL + signatureSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature for '%s': %w", rulesURL, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch signature for '%s' (%s), refusing unsigned ruleset", rulesURL, resp.Status)
+	}
+
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("failed to fetch signature for '%s': %w", rulesURL, err)
+	}
+
+	if err := Verify(data, string(sig), keys); err != nil {
+		return fmt.Errorf("refusing ruleset '%s': %w", rulesURL, err)
+	}
+
+	return nil
+}
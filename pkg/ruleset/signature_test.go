@@ -0,0 +1,83 @@
+package ruleset
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedRemoteRuleset(t *testing.T) {
+	publicKey, privateKey, err := GenerateKey()
+	assert.NoError(t, err)
+	otherKey, _, err := GenerateKey()
+	assert.NoError(t, err)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err = w.Write([]byte(validYAML))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	files := map[string][]byte{
+		"/rules.yaml":    []byte(validYAML),
+		"/rules.gz":      gz.Bytes(),
+		"/unsigned.yaml": []byte(validYAML),
+		"/tampered.yaml": []byte(validYAML + "\n- domain: evil.com\n"),
+	}
+	for _, name := range []string{"/rules.yaml", "/rules.gz"} {
+		sig, err := Sign(files[name], privateKey)
+		assert.NoError(t, err)
+		files[name+".sig"] = []byte(sig + "\n")
+	}
+	files["/tampered.yaml.sig"] = files["/rules.yaml.sig"]
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	// without trusted keys, nothing is verified
+	t.Setenv("RULESET_PUBLIC_KEYS", "")
+	_, _, err = fetchRemoteRules(server.URL+"/unsigned.yaml", nil)
+	assert.NoError(t, err)
+
+	t.Setenv("RULESET_PUBLIC_KEYS", otherKey+";"+publicKey)
+
+	testCases := []struct {
+		path string
+		err  string
+	}{
+		{"/rules.yaml", ""},
+		{"/rules.gz", ""},
+		{"/unsigned.yaml", "refusing unsigned ruleset"},
+		{"/tampered.yaml", "does not match any trusted key"},
+	}
+
+	for _, tc := range testCases {
+		rs, _, err := fetchRemoteRules(server.URL+tc.path, nil)
+		if tc.err == "" {
+			assert.NoError(t, err, tc.path)
+			assert.NotEmpty(t, rs, tc.path)
+		} else {
+			assert.ErrorContains(t, err, tc.err, tc.path)
+		}
+	}
+
+	// the load is refused when only an untrusted key signed the ruleset
+	t.Setenv("RULESET_PUBLIC_KEYS", otherKey)
+	_, _, err = fetchRemoteRules(server.URL+"/rules.yaml", nil)
+	assert.Error(t, err)
+
+	t.Setenv("RULESET_PUBLIC_KEYS", "not-a-key")
+	_, _, err = fetchRemoteRules(server.URL+"/rules.yaml", nil)
+	assert.ErrorContains(t, err, "invalid ruleset public key")
+}
@@ -0,0 +1 @@
+window.localStorage.clear();
@@ -0,0 +1,13 @@
+document.addEventListener("DOMContentLoaded", () => {
+  const subscriber_only = document.querySelectorAll('div.subscriber-only');
+  for (const elem of subscriber_only) {
+    if (elem.classList.contains('encrypted-content') && dompurify_loaded) {
+      const parser = new DOMParser();
+      const doc = parser.parseFromString('<div>' + DOMPurify.sanitize(unscramble(elem.innerText)) + '</div>', 'text/html');
+      const content_new = doc.querySelector('div');
+      elem.parentNode.replaceChild(content_new, elem);
+    }
+    elem.removeAttribute('style');
+    elem.removeAttribute('class');
+  }
+});
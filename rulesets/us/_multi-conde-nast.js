@@ -0,0 +1,4 @@
+document.addEventListener("DOMContentLoaded", () => {
+  const banners = document.querySelectorAll('.paywall-bar, div[class^="MessageBannerWrapper-"');
+  banners.forEach(el => { el.remove(); });
+});